@@ -0,0 +1,239 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"go.aporeto.io/gaia/types"
+)
+
+// AuthentifyCacheStats contains the statistics
+// of an AuthentifyCache.
+type AuthentifyCacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Size        int
+}
+
+type cacheEntry struct {
+	key           [sha256.Size]byte
+	claims        []string
+	midgardClaims *types.MidgardClaims
+	err           error
+	expiresAt     time.Time
+}
+
+// An AuthentifyCache caches the results of Client.Authentify
+// and Client.AuthentifyClaims.
+// Tokens are never stored: entries are keyed by a hash of the token.
+//
+// Successful results expire at the earlier of the configured TTL and
+// the expiration time of the token. Rejected tokens are cached for
+// the configured negative TTL. Transient errors are never cached.
+// When the cache is full, the least recently used entry is evicted.
+// Tokens revoked through Client.Revoke are never cached again
+// as accepted for the configured TTL.
+type AuthentifyCache struct {
+	maxEntries  int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	entries    map[[sha256.Size]byte]*list.Element
+	tombstones map[[sha256.Size]byte]time.Time
+	lru        *list.List
+	stats      AuthentifyCacheStats
+	now        func() time.Time
+	lock       sync.Mutex
+}
+
+// NewAuthentifyCache returns a new AuthentifyCache holding at most maxEntries
+// entries. Successful results are kept at most for ttl and rejected tokens
+// for negativeTTL. If negativeTTL is 0, rejected tokens are not cached.
+func NewAuthentifyCache(maxEntries int, ttl time.Duration, negativeTTL time.Duration) *AuthentifyCache {
+
+	if maxEntries <= 0 {
+		panic("maxEntries must be greater than 0")
+	}
+
+	if ttl <= 0 {
+		panic("ttl must be greater than 0")
+	}
+
+	return &AuthentifyCache{
+		maxEntries:  maxEntries,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     map[[sha256.Size]byte]*list.Element{},
+		tombstones:  map[[sha256.Size]byte]time.Time{},
+		lru:         list.New(),
+		now:         time.Now,
+	}
+}
+
+// Stats returns the current statistics of the cache.
+func (c *AuthentifyCache) Stats() AuthentifyCacheStats {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Size = c.lru.Len()
+
+	return stats
+}
+
+// Invalidate removes the given token from the cache.
+func (c *AuthentifyCache) Invalidate(token string) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[sha256.Sum256([]byte(token))]; ok {
+		c.remove(elem)
+	}
+}
+
+// Purge removes all entries from the cache.
+func (c *AuthentifyCache) Purge() {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = map[[sha256.Size]byte]*list.Element{}
+	c.lru.Init()
+}
+
+// revoke removes the given token from the cache and refuses to
+// cache it as accepted for the ttl, so an Authentify that started
+// before the revocation cannot cache it again once it completes.
+func (c *AuthentifyCache) revoke(token string) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	for key, expiresAt := range c.tombstones {
+		if !now.Before(expiresAt) {
+			delete(c.tombstones, key)
+		}
+	}
+
+	key := sha256.Sum256([]byte(token))
+	c.tombstones[key] = now.Add(c.ttl)
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// get returns the cached claims or rejection
+// error for the given token, if any.
+func (c *AuthentifyCache) get(token string) (cacheEntry, bool) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[sha256.Sum256([]byte(token))]
+	if !ok {
+		c.stats.Misses++
+		return cacheEntry{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+
+	if !c.now().Before(entry.expiresAt) {
+		c.remove(elem)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return cacheEntry{}, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+
+	return cacheEntry{
+		claims:        append([]string(nil), entry.claims...),
+		midgardClaims: entry.midgardClaims,
+		err:           entry.err,
+	}, true
+}
+
+// add caches the given claims for the given token
+// until the given token expiration time.
+func (c *AuthentifyCache) add(token string, claims []string, midgardClaims *types.MidgardClaims, tokenExpiresAt time.Time) {
+
+	expiresAt := c.now().Add(c.ttl)
+	if !tokenExpiresAt.IsZero() && tokenExpiresAt.Before(expiresAt) {
+		expiresAt = tokenExpiresAt
+	}
+
+	c.set(token, &cacheEntry{
+		claims:        append([]string(nil), claims...),
+		midgardClaims: midgardClaims,
+		expiresAt:     expiresAt,
+	})
+}
+
+// addNegative caches the given rejection error for the given token.
+func (c *AuthentifyCache) addNegative(token string, err error) {
+
+	if c.negativeTTL <= 0 {
+		return
+	}
+
+	c.set(token, &cacheEntry{
+		err:       err,
+		expiresAt: c.now().Add(c.negativeTTL),
+	})
+}
+
+func (c *AuthentifyCache) set(token string, entry *cacheEntry) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	if !now.Before(entry.expiresAt) {
+		return
+	}
+
+	entry.key = sha256.Sum256([]byte(token))
+
+	if expiresAt, ok := c.tombstones[entry.key]; ok && entry.err == nil && now.Before(expiresAt) {
+		return
+	}
+
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *AuthentifyCache) remove(elem *list.Element) {
+
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
@@ -0,0 +1,286 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAuthentifyCache(t *testing.T) {
+
+	Convey("Given I create a cache with invalid parameters", t, func() {
+		So(func() { NewAuthentifyCache(0, time.Minute, 0) }, ShouldPanicWith, "maxEntries must be greater than 0")
+		So(func() { NewAuthentifyCache(1, 0, 0) }, ShouldPanicWith, "ttl must be greater than 0")
+	})
+
+	Convey("Given I have a cache", t, func() {
+
+		now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		c := NewAuthentifyCache(2, time.Minute, 10*time.Second)
+		c.now = func() time.Time { return now }
+
+		Convey("When I get a missing token", func() {
+
+			_, ok := c.get("a")
+
+			Convey("Then it should be a miss", func() {
+				So(ok, ShouldBeFalse)
+				So(c.Stats().Misses, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I add a token", func() {
+
+			c.add("a", []string{"@auth:subject=a"}, nil, time.Time{})
+
+			Convey("Then I should get it back", func() {
+				e, ok := c.get("a")
+				So(ok, ShouldBeTrue)
+				So(e.claims, ShouldResemble, []string{"@auth:subject=a"})
+				So(e.err, ShouldBeNil)
+				So(c.Stats().Hits, ShouldEqual, 1)
+				So(c.Stats().Size, ShouldEqual, 1)
+			})
+
+			Convey("Then it should expire after the ttl", func() {
+				now = now.Add(time.Minute)
+				_, ok := c.get("a")
+				So(ok, ShouldBeFalse)
+				So(c.Stats().Expirations, ShouldEqual, 1)
+				So(c.Stats().Size, ShouldEqual, 0)
+			})
+
+			Convey("Then I should be able to invalidate it", func() {
+				c.Invalidate("a")
+				_, ok := c.get("a")
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then I should be able to purge it", func() {
+				c.Purge()
+				So(c.Stats().Size, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I add a token that expires before the ttl", func() {
+
+			c.add("a", []string{"@auth:subject=a"}, nil, now.Add(time.Second))
+
+			Convey("Then it should expire with the token", func() {
+				now = now.Add(time.Second)
+				_, ok := c.get("a")
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When I add an already expired token", func() {
+
+			c.add("a", []string{"@auth:subject=a"}, nil, now.Add(-time.Second))
+
+			Convey("Then it should not be cached", func() {
+				So(c.Stats().Size, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I add a rejected token", func() {
+
+			c.addNegative("a", errors.New("nope"))
+
+			Convey("Then I should get the error back", func() {
+				e, ok := c.get("a")
+				So(ok, ShouldBeTrue)
+				So(e.err, ShouldNotBeNil)
+			})
+
+			Convey("Then it should expire after the negative ttl", func() {
+				now = now.Add(10 * time.Second)
+				_, ok := c.get("a")
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When I revoke a token", func() {
+
+			c.add("a", []string{"@auth:subject=a"}, nil, time.Time{})
+			c.revoke("a")
+
+			Convey("Then it should be removed", func() {
+				_, ok := c.get("a")
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then it should not be cached again as accepted", func() {
+				c.add("a", []string{"@auth:subject=a"}, nil, time.Time{})
+				_, ok := c.get("a")
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Then it should still be cached as rejected", func() {
+				c.addNegative("a", errors.New("nope"))
+				e, ok := c.get("a")
+				So(ok, ShouldBeTrue)
+				So(e.err, ShouldNotBeNil)
+			})
+
+			Convey("Then it should be cached again after the ttl", func() {
+				now = now.Add(time.Minute)
+				c.add("a", []string{"@auth:subject=a"}, nil, time.Time{})
+				_, ok := c.get("a")
+				So(ok, ShouldBeTrue)
+			})
+
+			Convey("Then other tokens should still be cached", func() {
+				c.add("b", []string{"@auth:subject=b"}, nil, time.Time{})
+				_, ok := c.get("b")
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		Convey("When I add more tokens than the max entries", func() {
+
+			c.add("a", []string{"a"}, nil, time.Time{})
+			c.add("b", []string{"b"}, nil, time.Time{})
+			c.get("a")
+			c.add("c", []string{"c"}, nil, time.Time{})
+
+			Convey("Then the least recently used token should be evicted", func() {
+				_, okA := c.get("a")
+				_, okB := c.get("b")
+				_, okC := c.get("c")
+				So(okA, ShouldBeTrue)
+				So(okB, ShouldBeFalse)
+				So(okC, ShouldBeTrue)
+				So(c.Stats().Evictions, ShouldEqual, 1)
+				So(c.Stats().Size, ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Given I have a cache without negative ttl", t, func() {
+
+		c := NewAuthentifyCache(2, time.Minute, 0)
+
+		Convey("When I add a rejected token", func() {
+
+			c.addNegative("a", errors.New("nope"))
+
+			Convey("Then it should not be cached", func() {
+				So(c.Stats().Size, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestClient_AuthentifyWithCache(t *testing.T) {
+
+	Convey("Given I have a client with a cache and a working server", t, func() {
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			fmt.Fprintf(w, `{"claims": {"sub": "user", "exp": %d}}`, time.Now().Add(time.Hour).Unix())
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+		cl.AuthentifyCache = NewAuthentifyCache(10, time.Minute, time.Minute)
+
+		Convey("When I call Authentify twice with the same token", func() {
+
+			n1, err1 := cl.Authentify(context.Background(), "thetoken")
+			n2, err2 := cl.Authentify(context.Background(), "thetoken")
+
+			Convey("Then I should get the same claims", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(n1, ShouldResemble, []string{"@auth:subject=user"})
+				So(n2, ShouldResemble, n1)
+			})
+
+			Convey("Then the server should have been called once", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 1)
+				So(cl.AuthentifyCache.Stats().Hits, ShouldEqual, 1)
+				So(cl.AuthentifyCache.Stats().Misses, ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("Given I have a client with a cache and a server that rejects tokens", t, func() {
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+		cl.AuthentifyCache = NewAuthentifyCache(10, time.Minute, time.Minute)
+
+		Convey("When I call Authentify twice with the same token", func() {
+
+			_, err1 := cl.Authentify(context.Background(), "thetoken")
+			_, err2 := cl.Authentify(context.Background(), "thetoken")
+
+			Convey("Then I should get the same error", func() {
+				So(IsUnauthorized(err1), ShouldBeTrue)
+				So(err2, ShouldEqual, err1)
+			})
+
+			Convey("Then the server should have been called once", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("Given I have a client with a cache and an unavailable server", t, func() {
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ts.Close()
+
+		p := DefaultRetryPolicy()
+		p.MaxAttempts = 1
+		cl := NewClientWithRetryPolicy(ts.URL, &tls.Config{}, p)
+		cl.AuthentifyCache = NewAuthentifyCache(10, time.Minute, time.Minute)
+
+		Convey("When I call Authentify twice with the same token", func() {
+
+			_, err1 := cl.Authentify(context.Background(), "thetoken")
+			_, err2 := cl.Authentify(context.Background(), "thetoken")
+
+			Convey("Then I should get errors", func() {
+				So(err1, ShouldNotBeNil)
+				So(err2, ShouldNotBeNil)
+			})
+
+			Convey("Then the server should have been called twice", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 2)
+				So(cl.AuthentifyCache.Stats().Size, ShouldEqual, 0)
+			})
+		})
+	})
+}
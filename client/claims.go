@@ -0,0 +1,141 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.aporeto.io/gaia/types"
+)
+
+// Claims is a typed view of MidgardClaims.
+type Claims struct {
+	claims *types.MidgardClaims
+}
+
+// NewClaims returns a typed view of the given MidgardClaims.
+func NewClaims(c *types.MidgardClaims) *Claims {
+
+	if c == nil {
+		c = &types.MidgardClaims{}
+	}
+
+	return &Claims{
+		claims: c,
+	}
+}
+
+// UnsecureTypedClaimsFromToken returns the typed claims contained
+// in the given token. Like UnsecureClaimsFromToken, it doesn't
+// verify the token signature.
+func UnsecureTypedClaimsFromToken(token string) (*Claims, error) {
+
+	c := &types.MidgardClaims{}
+	p := jwt.Parser{}
+
+	if _, _, err := p.ParseUnverified(token, c); err != nil {
+		return nil, err
+	}
+
+	return NewClaims(c), nil
+}
+
+// MidgardClaims returns the underlying MidgardClaims.
+func (c *Claims) MidgardClaims() *types.MidgardClaims {
+
+	return c.claims
+}
+
+// Subject returns the subject of the token.
+func (c *Claims) Subject() string {
+
+	return c.claims.Subject
+}
+
+// Realm returns the realm the token was issued from.
+func (c *Claims) Realm() string {
+
+	return c.claims.Realm
+}
+
+// Namespace returns the namespace of the identity
+// the token was issued for, if any.
+func (c *Claims) Namespace() string {
+
+	return c.claims.Data["namespace"]
+}
+
+// ExpiresAt returns the expiration time of the token.
+// It is zero if the token does not expire.
+func (c *Claims) ExpiresAt() time.Time {
+
+	if c.claims.ExpiresAt == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(c.claims.ExpiresAt, 0)
+}
+
+// IssuedAt returns the time the token was issued at.
+// It is zero if the token does not contain it.
+func (c *Claims) IssuedAt() time.Time {
+
+	if c.claims.IssuedAt == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(c.claims.IssuedAt, 0)
+}
+
+// Quota returns the number of times the token
+// can be used. It is 0 if the token is unlimited.
+func (c *Claims) Quota() int {
+
+	return c.claims.Quota
+}
+
+// Data returns the value of the given key from the
+// data of the token, and whether it is present.
+func (c *Claims) Data(key string) (string, bool) {
+
+	v, ok := c.claims.Data[key]
+
+	return v, ok
+}
+
+// Opaque returns a copy of the opaque data of the token.
+func (c *Claims) Opaque() map[string]string {
+
+	if c.claims.Opaque == nil {
+		return nil
+	}
+
+	opaque := make(map[string]string, len(c.claims.Opaque))
+	for k, v := range c.claims.Opaque {
+		opaque[k] = v
+	}
+
+	return opaque
+}
+
+// Restrictions returns the restrictions of the token.
+func (c *Claims) Restrictions() Restrictions {
+
+	return RestrictionsFromMidgardClaims(c.claims)
+}
+
+// Tags returns the claims normalized as tags, as NormalizeAuth does.
+func (c *Claims) Tags() []string {
+
+	return NormalizeAuth(c.claims)
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia/types"
+)
+
+func TestClaims_Accessors(t *testing.T) {
+
+	Convey("Given I have typed claims", t, func() {
+
+		mc := &types.MidgardClaims{}
+		if err := json.Unmarshal([]byte(`{
+			"realm": "certificate",
+			"quota": 3,
+			"data": {"namespace": "/a/b", "commonName": "john", "empty": ""},
+			"opaque": {"k": "v"},
+			"restrictions": {"namespace": "/a/b/c", "perms": ["@auth:role=reader"], "networks": ["10.0.0.0/8"]},
+			"sub": "john",
+			"exp": 1000,
+			"iat": 500
+		}`), mc); err != nil {
+			panic(err)
+		}
+
+		c := NewClaims(mc)
+
+		Convey("Then the accessors should return the correct values", func() {
+			So(c.MidgardClaims(), ShouldEqual, mc)
+			So(c.Subject(), ShouldEqual, "john")
+			So(c.Realm(), ShouldEqual, "certificate")
+			So(c.Namespace(), ShouldEqual, "/a/b")
+			So(c.ExpiresAt(), ShouldResemble, time.Unix(1000, 0))
+			So(c.IssuedAt(), ShouldResemble, time.Unix(500, 0))
+			So(c.Quota(), ShouldEqual, 3)
+		})
+
+		Convey("Then Data should return the data keys", func() {
+			v, ok := c.Data("commonName")
+			So(ok, ShouldBeTrue)
+			So(v, ShouldEqual, "john")
+			_, ok = c.Data("nope")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Then Opaque should return a copy of the opaque data", func() {
+			o := c.Opaque()
+			So(o, ShouldResemble, map[string]string{"k": "v"})
+			o["k"] = "changed"
+			So(mc.Opaque["k"], ShouldEqual, "v")
+		})
+
+		Convey("Then Restrictions should return the restrictions", func() {
+			So(c.Restrictions(), ShouldResemble, Restrictions{
+				Namespace:   "/a/b/c",
+				Permissions: []string{"@auth:role=reader"},
+				Networks:    []string{"10.0.0.0/8"},
+			})
+		})
+
+		Convey("Then Tags should be the same as NormalizeAuth", func() {
+			So(c.Tags(), ShouldResemble, NormalizeAuth(mc))
+			So(c.Tags(), ShouldResemble, []string{
+				"@auth:commonname=john",
+				"@auth:namespace=/a/b",
+				"@auth:subject=john",
+			})
+		})
+	})
+
+	Convey("Given I have typed claims from nil", t, func() {
+
+		c := NewClaims(nil)
+
+		Convey("Then the accessors should return zero values", func() {
+			So(c.Subject(), ShouldEqual, "")
+			So(c.ExpiresAt().IsZero(), ShouldBeTrue)
+			So(c.IssuedAt().IsZero(), ShouldBeTrue)
+			So(c.Opaque(), ShouldBeNil)
+			So(c.Tags(), ShouldBeNil)
+			So(c.Restrictions(), ShouldResemble, Restrictions{})
+		})
+	})
+}
+
+func TestClaims_UnsecureTypedClaimsFromToken(t *testing.T) {
+
+	Convey("Given I have a token", t, func() {
+
+		token := makeTokenWithKID(&types.MidgardClaims{
+			Realm:          "vince",
+			Data:           map[string]string{"account": "acme"},
+			StandardClaims: jwt.StandardClaims{Subject: "acme"},
+		}, "", key(signerKey))
+
+		Convey("When I get the typed claims", func() {
+
+			c, err := UnsecureTypedClaimsFromToken(token)
+
+			Convey("Then they should be correct", func() {
+				So(err, ShouldBeNil)
+				So(c.Realm(), ShouldEqual, "vince")
+				So(c.Subject(), ShouldEqual, "acme")
+			})
+
+			Convey("Then Tags should match UnsecureClaimsFromToken", func() {
+				tags, err := UnsecureClaimsFromToken(token)
+				So(err, ShouldBeNil)
+				So(c.Tags(), ShouldResemble, tags)
+			})
+		})
+
+		Convey("When I get the typed claims from an invalid token", func() {
+
+			c, err := UnsecureTypedClaimsFromToken("nope")
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+				So(c, ShouldBeNil)
+			})
+		})
+	})
+}
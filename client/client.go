@@ -15,34 +15,101 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
-	opentracing "github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/log"
 	"go.aporeto.io/elemental"
 	"go.aporeto.io/gaia"
+	"go.aporeto.io/gaia/types"
 	"go.aporeto.io/midgard-lib/ldaputils"
 	"go.aporeto.io/midgard-lib/tokenmanager/providers"
 	"go.aporeto.io/tg/tglib"
+	"go.uber.org/zap"
 )
 
+// maxDrainSize is the maximum number of bytes read from a
+// response body before closing it, so the connection can be
+// reused. Larger bodies are discarded with their connection.
+const maxDrainSize = 64 << 10
+
 // A Client allows to interract with a midgard server.
 type Client struct {
 	TrackingType string
 
-	url        string
-	tlsConfig  *tls.Config
-	httpClient *http.Client
+	// AuthentifyCache, if set, caches the results of Authentify.
+	AuthentifyCache *AuthentifyCache
+
+	// Tracer, if set, is used to trace the requests instead
+	// of the opentracing global tracer.
+	Tracer Tracer
+
+	// Metrics, if set, records metrics about the requests.
+	Metrics MetricsRecorder
+
+	endpoints   *endpointPool
+	httpClient  *http.Client
+	retryPolicy RetryPolicy
+	userAgent   string
+	headers     http.Header
+	logger      *zap.Logger
+}
+
+// New returns a new Client sending requests to the given midgard URL,
+// configured with the given options. Unlike NewClient, it returns an
+// error instead of panicking if the client cannot be configured.
+func New(midgardURL string, options ...ClientOption) (*Client, error) {
+
+	opts := newClientOpts()
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	if midgardURL == "" {
+		return nil, fmt.Errorf("missing midgard url")
+	}
+
+	u, err := url.Parse(midgardURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid midgard url: %w", err)
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid midgard url '%s': missing scheme or host", midgardURL)
+	}
+
+	if opts.httpClient != nil && opts.roundTripper != nil {
+		return nil, fmt.Errorf("OptClientHTTPClient and OptClientRoundTripper cannot be used together")
+	}
+
+	if opts.timeout < 0 {
+		return nil, fmt.Errorf("timeout must be a positive duration")
+	}
+
+	if opts.maxIdleConns < 0 || opts.maxIdleConnsPerHost < 0 || opts.idleConnTimeout < 0 {
+		return nil, fmt.Errorf("idle connection limits must be positive")
+	}
+
+	if opts.tlsConfig == nil && opts.httpClient == nil && opts.roundTripper == nil {
+		pool, err := tglib.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load system cert pool: %w", err)
+		}
+		opts.tlsConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return newClient([]string{midgardURL}, opts), nil
 }
 
 // NewClient returns a new Client.
+// It panics if the system cert pool cannot be loaded.
+// Use New to get an error instead.
 func NewClient(url string) *Client {
 
 	CAPool, err := tglib.SystemCertPool()
@@ -61,24 +128,85 @@ func NewClient(url string) *Client {
 // NewClientWithTLS returns a new Client configured with the given x509.CAPool.
 func NewClientWithTLS(url string, tlsConfig *tls.Config) *Client {
 
-	if url == "" {
+	return NewClientWithRetryPolicy(url, tlsConfig, DefaultRetryPolicy())
+}
+
+// NewClientWithRetryPolicy returns a new Client configured with the given x509.CAPool
+// that will retry failed requests according to the given RetryPolicy.
+func NewClientWithRetryPolicy(url string, tlsConfig *tls.Config, retryPolicy RetryPolicy) *Client {
+
+	return NewClientWithEndpoints([]string{url}, tlsConfig, retryPolicy)
+}
+
+// NewClientWithEndpoints returns a new Client that sends requests to the
+// given list of midgard URLs. Endpoints are tried in the given order and
+// an endpoint that fails is ejected until it recovers, so requests fail over
+// to the next healthy endpoint.
+func NewClientWithEndpoints(urls []string, tlsConfig *tls.Config, retryPolicy RetryPolicy) *Client {
+
+	if len(urls) == 0 {
 		panic("Missing Midgard URL.")
 	}
 
+	for _, u := range urls {
+		if u == "" {
+			panic("Missing Midgard URL.")
+		}
+	}
+
+	opts := newClientOpts()
+	opts.tlsConfig = tlsConfig
+	opts.retryPolicy = retryPolicy
+
+	return newClient(urls, opts)
+}
+
+// newClient returns a new Client sending
+// requests to the given urls with the given options.
+func newClient(urls []string, opts clientOpts) *Client {
+
+	httpClient := opts.httpClient
+	if httpClient == nil {
+		transport := opts.roundTripper
+		if transport == nil {
+			transport = &http.Transport{
+				ForceAttemptHTTP2:   true,
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     opts.tlsConfig,
+				MaxIdleConns:        opts.maxIdleConns,
+				MaxIdleConnsPerHost: opts.maxIdleConnsPerHost,
+				IdleConnTimeout:     opts.idleConnTimeout,
+				DisableKeepAlives:   opts.disableKeepAlives,
+			}
+		}
+		httpClient = &http.Client{
+			Transport: transport,
+		}
+	} else {
+		copied := *httpClient
+		httpClient = &copied
+	}
+
+	// The redirections returned by midgard, like the auth URLs of
+	// the OIDC and SAML providers, must be returned, not followed.
+	httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	if opts.httpClient == nil || opts.hasTimeout {
+		httpClient.Timeout = opts.timeout
+	}
+
 	return &Client{
-		url:       url,
-		tlsConfig: tlsConfig,
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-			Transport: &http.Transport{
-				ForceAttemptHTTP2: true,
-				Proxy:             http.ProxyFromEnvironment,
-				TLSClientConfig:   tlsConfig,
-			},
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-		},
+		TrackingType: opts.trackingType,
+		Tracer:       opts.tracer,
+		Metrics:      opts.metrics,
+		endpoints:    newEndpointPool(urls),
+		retryPolicy:  opts.retryPolicy,
+		httpClient:   httpClient,
+		userAgent:    opts.userAgent,
+		headers:      opts.headers,
+		logger:       opts.logger,
 	}
 }
 
@@ -86,127 +214,212 @@ func NewClientWithTLS(url string, tlsConfig *tls.Config) *Client {
 // returns a list of tag string containing the claims.
 func (a *Client) Authentify(ctx context.Context, token string) ([]string, error) {
 
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.authentify")
+	span, subctx := a.tracer().StartSpan(ctx, "midgardlib.client.authentify")
 	defer span.Finish()
 
-	builder := func() (*http.Request, error) {
+	normalized, _, err := a.authentifyCached(subctx, span, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalized, nil
+}
+
+// AuthentifyClaims authentifies the given token like Authentify, but returns
+// the full claims it contains, including its expiration time, issuer, audience
+// and restrictions. The claims may be shared with the AuthentifyCache and must
+// not be modified.
+func (a *Client) AuthentifyClaims(ctx context.Context, token string) (*Claims, error) {
+
+	span, subctx := a.tracer().StartSpan(ctx, "midgardlib.client.authentify.claims")
+	defer span.Finish()
+
+	_, claims, err := a.authentifyCached(subctx, span, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClaims(claims), nil
+}
+
+// authentifyCached returns the normalized and full claims of the
+// given token from the AuthentifyCache, if any, or from midgard.
+func (a *Client) authentifyCached(ctx context.Context, span Span, token string) ([]string, *types.MidgardClaims, error) {
+
+	if a.AuthentifyCache == nil {
+		claims, err := a.authentify(ctx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NormalizeAuth(claims), claims, nil
+	}
+
+	if entry, ok := a.AuthentifyCache.get(token); ok {
+		span.SetTag("cache", "hit")
+		if entry.err != nil {
+			return nil, nil, entry.err
+		}
+		return entry.claims, entry.midgardClaims, nil
+	}
+
+	span.SetTag("cache", "miss")
+
+	claims, err := a.authentify(ctx, token)
+	if err != nil {
+		if IsUnauthorized(err) {
+			a.AuthentifyCache.addNegative(token, err)
+		}
+		return nil, nil, err
+	}
+
+	normalized := NormalizeAuth(claims)
+
+	var expiresAt time.Time
+	if claims.ExpiresAt > 0 {
+		expiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+
+	a.AuthentifyCache.add(token, normalized, claims, expiresAt)
+
+	return normalized, claims, nil
+}
+
+// authentify sends the given token to midgard and returns the claims it contains.
+func (a *Client) authentify(ctx context.Context, token string) (claims *types.MidgardClaims, err error) {
+
+	defer func(start time.Time) { a.metrics().ObserveAuthn(time.Since(start), err) }(time.Now())
+
+	builder := func(baseURL string) (*http.Request, error) {
 		authn := gaia.NewAuthn()
 		authn.Token = token
 		data, err := json.Marshal(authn)
 		if err != nil {
 			return nil, err
 		}
-		return http.NewRequest(http.MethodPost, a.url+"/authn", bytes.NewBuffer(data))
+		return http.NewRequest(http.MethodPost, baseURL+"/authn", bytes.NewBuffer(data))
 	}
 
-	resp, err := a.sendRetry(subctx, builder, token)
+	resp, endpoint, err := a.sendRetry(ctx, builder, token)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, elemental.NewError("Unauthorized", fmt.Sprintf("Authentication rejected with error: %s", resp.Status), "midgard-lib", http.StatusUnauthorized)
+		rerr := newRequestError(resp, endpoint)
+		if len(rerr.Errors) == 0 {
+			rerr.Errors = elemental.NewErrors(
+				elemental.NewError(http.StatusText(resp.StatusCode), fmt.Sprintf("Authentication rejected with error: %s", resp.Status), "midgard-lib", resp.StatusCode),
+			)
+		}
+		return nil, rerr
 	}
 
 	auth := gaia.NewAuthn()
 
-	defer resp.Body.Close() // nolint: errcheck
+	defer drainBody(resp.Body)
 
 	if err := json.NewDecoder(resp.Body).Decode(auth); err != nil {
 		return nil, err
 	}
 
 	if auth.Claims == nil {
-		return nil, elemental.NewError("Unauthorized", "No claims returned. Token may be invalid", "midgard-lib", http.StatusUnauthorized)
+		return nil, &RequestError{
+			StatusCode: http.StatusUnauthorized,
+			Endpoint:   endpoint,
+			Errors: elemental.NewErrors(
+				elemental.NewError("Unauthorized", "No claims returned. Token may be invalid", "midgard-lib", http.StatusUnauthorized),
+			),
+		}
 	}
 
-	return NormalizeAuth(auth.Claims), nil
+	return auth.Claims, nil
 }
 
-// IssueFromGoogle issues a Midgard jwt from a Google JWT for the given validity duration.
-func (a *Client) IssueFromGoogle(ctx context.Context, googleJWT string, validity time.Duration, options ...Option) (string, error) {
+// Revoke asks midgard to revoke the given token so it cannot be used
+// anymore. Any token can be revoked, including the ones derived from
+// another token with IssueFromAporetoIdentityToken. The token is also
+// removed from the AuthentifyCache, if any, before being revoked and is
+// not cached again as accepted for the TTL of the cache, even by an
+// Authentify that was in flight while revoking.
+func (a *Client) Revoke(ctx context.Context, token string) error {
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
+	span, subctx := a.tracer().StartSpan(ctx, "midgardlib.client.revoke")
+	defer span.Finish()
+
+	// The token is removed before contacting midgard, as it
+	// may already be revoked if the request fails afterwards.
+	if a.AuthentifyCache != nil {
+		a.AuthentifyCache.revoke(token)
 	}
 
-	issueRequest := gaia.NewIssue()
-	issueRequest.Realm = gaia.IssueRealmGoogle
-	issueRequest.Data = googleJWT
-	issueRequest.Validity = validity.String()
+	data, err := json.Marshal(&revocationRequest{Token: token})
+	if err != nil {
+		return err
+	}
 
-	applyOptions(issueRequest, opts)
+	builder := func(baseURL string) (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, baseURL+"/revoke", bytes.NewBuffer(data))
+	}
 
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.google")
-	defer span.Finish()
+	resp, endpoint, err := a.sendRetry(subctx, builder, token)
+	if err != nil {
+		span.SetError(err)
+		return err
+	}
 
-	return a.sendRequest(subctx, issueRequest)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		rerr := newRequestError(resp, endpoint)
+		span.SetError(rerr)
+		return rerr
+	}
+
+	drainBody(resp.Body)
+
+	return nil
 }
 
-// IssueFromCertificate issues a Midgard jwt from a certificate for the given validity duration.
-func (a *Client) IssueFromCertificate(ctx context.Context, validity time.Duration, options ...Option) (string, error) {
+// revocationRequest is the body of a revocation request.
+type revocationRequest struct {
+	Token string `json:"token"`
+}
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
+// IssueFromGoogle issues a Midgard jwt from a Google JWT for the given validity duration.
+func (a *Client) IssueFromGoogle(ctx context.Context, googleJWT string, validity time.Duration, options ...Option) (string, error) {
 
 	issueRequest := gaia.NewIssue()
-	issueRequest.Realm = gaia.IssueRealmCertificate
+	issueRequest.Realm = gaia.IssueRealmGoogle
+	issueRequest.Data = googleJWT
 	issueRequest.Validity = validity.String()
 
-	applyOptions(issueRequest, opts)
+	return a.issue(ctx, "midgardlib.client.issue.google", issueRequest, options)
+}
 
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.certificate")
-	defer span.Finish()
+// IssueFromCertificate issues a Midgard jwt from a certificate for the given validity duration.
+func (a *Client) IssueFromCertificate(ctx context.Context, validity time.Duration, options ...Option) (string, error) {
 
-	return a.sendRequest(subctx, issueRequest)
+	return a.Issue(ctx, gaia.IssueRealmCertificate, nil, validity, options...)
 }
 
 // IssueFromLDAP issues a Midgard JWT from an LDAP config for the given validity duration.
 func (a *Client) IssueFromLDAP(ctx context.Context, info *ldaputils.LDAPInfo, namespace string, provider string, validity time.Duration, options ...Option) (string, error) {
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
-
-	issueRequest := gaia.NewIssue()
-	issueRequest.Realm = gaia.IssueRealmLDAP
-	issueRequest.Validity = validity.String()
+	metadata := info.ToMap()
+	metadata["namespace"] = namespace
+	metadata["provider"] = provider
 
-	applyOptions(issueRequest, opts)
-
-	issueRequest.Metadata = info.ToMap()
-	issueRequest.Metadata["namespace"] = namespace
-	issueRequest.Metadata["provider"] = provider
-
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.ldap")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.Issue(ctx, gaia.IssueRealmLDAP, metadata, validity, options...)
 }
 
 // IssueFromVince issues a Midgard jwt from a Vince for the given one time password and validity duration.
 func (a *Client) IssueFromVince(ctx context.Context, account string, password string, otp string, validity time.Duration, options ...Option) (string, error) {
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
-
-	issueRequest := gaia.NewIssue()
-	issueRequest.Metadata = map[string]interface{}{"vinceAccount": account, "vincePassword": password, "vinceOTP": otp}
-	issueRequest.Realm = gaia.IssueRealmVince
-	issueRequest.Validity = validity.String()
-
-	applyOptions(issueRequest, opts)
-
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.vince")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.Issue(
+		ctx,
+		gaia.IssueRealmVince,
+		map[string]interface{}{"vinceAccount": account, "vincePassword": password, "vinceOTP": otp},
+		validity,
+		options...,
+	)
 }
 
 // IssueFromAporetoIdentityToken issues a Midgard jwt from an existing one.
@@ -215,33 +428,13 @@ func (a *Client) IssueFromVince(ctx context.Context, account string, password st
 // without needing the original source of authentication.
 func (a *Client) IssueFromAporetoIdentityToken(ctx context.Context, token string, validity time.Duration, options ...Option) (string, error) {
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
-
-	issueRequest := gaia.NewIssue()
-	issueRequest.Metadata = map[string]interface{}{"token": token}
-	issueRequest.Realm = gaia.IssueRealmAporetoIdentityToken
-	issueRequest.Validity = validity.String()
-
-	applyOptions(issueRequest, opts)
-
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.aporetoidentitytoken")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.Issue(ctx, gaia.IssueRealmAporetoIdentityToken, map[string]interface{}{"token": token}, validity, options...)
 }
 
 // IssueFromAWSSecurityToken issues a Midgard jwt from a security token from amazon.
 // If you don't pass anything, this function will try to retrieve the token using aws magic ip.
 func (a *Client) IssueFromAWSSecurityToken(ctx context.Context, accessKeyID, secretAccessKey, token string, validity time.Duration, options ...Option) (string, error) {
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
-
 	s := &struct {
 		AccessKeyID     string `json:"AccessKeyId"`
 		SecretAccessKey string
@@ -268,16 +461,10 @@ func (a *Client) IssueFromAWSSecurityToken(ctx context.Context, accessKeyID, sec
 		"secretAccessKey": s.SecretAccessKey,
 		"token":           s.Token,
 	}
-
 	issueRequest.Realm = gaia.IssueRealmAWSSecurityToken
 	issueRequest.Validity = validity.String()
 
-	applyOptions(issueRequest, opts)
-
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.aws")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.issue(ctx, "midgardlib.client.issue.aws", issueRequest, options)
 }
 
 // IssueFromGCPIdentityToken issues a Midgard jwt from a signed GCP identity document for the given validity duration.
@@ -292,22 +479,12 @@ func (a *Client) IssueFromGCPIdentityToken(ctx context.Context, token string, va
 		}
 	}
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
-
 	issueRequest := gaia.NewIssue()
 	issueRequest.Metadata = map[string]interface{}{"token": token}
 	issueRequest.Realm = gaia.IssueRealmGCPIdentityToken
 	issueRequest.Validity = validity.String()
 
-	applyOptions(issueRequest, opts)
-
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.gcp")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.issue(ctx, "midgardlib.client.issue.gcp", issueRequest, options)
 }
 
 // IssueFromOIDCStep1 issues a Midgard jwt from a OICD provider. This is performing the first step to
@@ -322,21 +499,13 @@ func (a *Client) IssueFromOIDCStep1(ctx context.Context, namespace string, provi
 	}
 	issueRequest.Realm = gaia.IssueRealmOIDC
 
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.oidc.step1")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.issue(ctx, "midgardlib.client.issue.oidc.step1", issueRequest, nil)
 }
 
 // IssueFromOIDCStep2 issues a Midgard jwt from a OICD provider. This is performing the second step to
 // to exchange the code for a Midgard HWT.
 func (a *Client) IssueFromOIDCStep2(ctx context.Context, code string, state string, validity time.Duration, options ...Option) (string, error) {
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
-
 	issueRequest := gaia.NewIssue()
 	issueRequest.Metadata = map[string]interface{}{
 		"code":  code,
@@ -345,12 +514,7 @@ func (a *Client) IssueFromOIDCStep2(ctx context.Context, code string, state stri
 	issueRequest.Realm = gaia.IssueRealmOIDC
 	issueRequest.Validity = validity.String()
 
-	applyOptions(issueRequest, opts)
-
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.oidc.step2")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.issue(ctx, "midgardlib.client.issue.oidc.step2", issueRequest, options)
 }
 
 // IssueFromSAMLStep1 issues a Midgard jwt from a SAML provider. This is performing the first step to
@@ -365,21 +529,13 @@ func (a *Client) IssueFromSAMLStep1(ctx context.Context, namespace string, provi
 	}
 	issueRequest.Realm = gaia.IssueRealmSAML
 
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.saml.step1")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.issue(ctx, "midgardlib.client.issue.saml.step1", issueRequest, nil)
 }
 
 // IssueFromSAMLStep2 issues a Midgard jwt from a SAML provider. This is performing the second step to
 // to exchange the code for a Midgard HWT.
 func (a *Client) IssueFromSAMLStep2(ctx context.Context, response string, state string, validity time.Duration, options ...Option) (string, error) {
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
-
 	issueRequest := gaia.NewIssue()
 	issueRequest.Metadata = map[string]interface{}{
 		"SAMLResponse": response,
@@ -388,12 +544,7 @@ func (a *Client) IssueFromSAMLStep2(ctx context.Context, response string, state
 	issueRequest.Realm = gaia.IssueRealmSAML
 	issueRequest.Validity = validity.String()
 
-	applyOptions(issueRequest, opts)
-
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.saml.step2")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.issue(ctx, "midgardlib.client.issue.saml.step2", issueRequest, options)
 }
 
 // IssueFromAzureIdentityToken issues a Midgard jwt from a signed Azure identity document for the given validity duration.
@@ -408,25 +559,19 @@ func (a *Client) IssueFromAzureIdentityToken(ctx context.Context, token string,
 		}
 	}
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
-
 	issueRequest := gaia.NewIssue()
 	issueRequest.Metadata = map[string]interface{}{"token": token}
 	issueRequest.Realm = gaia.IssueRealmAzureIdentityToken
 	issueRequest.Validity = validity.String()
 
-	applyOptions(issueRequest, opts)
-
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.azure")
-	defer span.Finish()
-
-	return a.sendRequest(subctx, issueRequest)
+	return a.issue(ctx, "midgardlib.client.issue.azure", issueRequest, options)
 }
 
-func (a *Client) sendRequest(ctx context.Context, issueRequest *gaia.Issue) (string, error) {
+func (a *Client) sendRequest(ctx context.Context, issueRequest *gaia.Issue, secrets ...string) (token string, err error) {
+
+	defer func(start time.Time) {
+		a.metrics().ObserveIssue(string(issueRequest.Realm), time.Since(start), err)
+	}(time.Now())
 
 	buffer := &bytes.Buffer{}
 	if err := json.NewEncoder(buffer).Encode(issueRequest); err != nil {
@@ -434,39 +579,27 @@ func (a *Client) sendRequest(ctx context.Context, issueRequest *gaia.Issue) (str
 	}
 	body := buffer.Bytes()
 
-	builder := func() (*http.Request, error) {
+	builder := func(baseURL string) (*http.Request, error) {
 
-		return http.NewRequest(http.MethodPost, a.url+"/issue", bytes.NewBuffer(body))
+		return http.NewRequest(http.MethodPost, baseURL+"/issue", bytes.NewBuffer(body))
 	}
 
-	resp, err := a.sendRetry(ctx, builder, "")
+	resp, endpoint, err := a.sendRetry(ctx, builder, secrets...)
 	if err != nil {
-		return "", err
+		return "", withRealm(err, string(issueRequest.Realm))
 	}
 
 	if resp.StatusCode == http.StatusFound {
+		drainBody(resp.Body)
 		return resp.Header.Get("Location"), nil
 	}
 
-	defer resp.Body.Close() // nolint: errcheck
-
-	if resp.StatusCode != 200 {
-
-		// Read the response body
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", fmt.Errorf("midgard did not issue a token and client could not read why: %s (statusCode: %d)", err, resp.StatusCode)
-		}
-
-		// Try to decode the errors
-		errs, err := elemental.DecodeErrors(data)
-		if err != nil {
-			return "", fmt.Errorf("midgard did not issue a token and client could not decode why: %s (statusCode: %d)", err, resp.StatusCode)
-		}
-
-		return "", errs
+	if resp.StatusCode != http.StatusOK {
+		return "", withRealm(newRequestError(resp, endpoint), string(issueRequest.Realm))
 	}
 
+	defer drainBody(resp.Body)
+
 	if err := json.NewDecoder(resp.Body).Decode(issueRequest); err != nil {
 		return "", err
 	}
@@ -477,77 +610,233 @@ func (a *Client) sendRequest(ctx context.Context, issueRequest *gaia.Issue) (str
 // IssueFromPCIdentityToken issues a Midgard jwt from a PCC token.
 func (a *Client) IssueFromPCIdentityToken(ctx context.Context, token string, validity time.Duration, options ...Option) (string, error) {
 
-	opts := issueOpts{}
-	for _, opt := range options {
-		opt(&opts)
-	}
+	return a.Issue(ctx, gaia.IssueRealmPCIdentityToken, map[string]interface{}{"token": token}, validity, options...)
+}
 
-	issueRequest := gaia.NewIssue()
-	issueRequest.Metadata = map[string]interface{}{"token": token}
-	issueRequest.Realm = gaia.IssueRealmPCIdentityToken
-	issueRequest.Validity = validity.String()
+// CloseIdleConnections closes the idle connections to midgard, so the next
+// requests use new connections, for instance after the client certificate
+// changed.
+func (a *Client) CloseIdleConnections() {
 
-	applyOptions(issueRequest, opts)
+	a.httpClient.CloseIdleConnections()
+}
 
-	span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.issue.pcidentitytoken")
-	defer span.Finish()
+// EndpointsHealth returns the current health of the
+// midgard endpoints used by the client.
+func (a *Client) EndpointsHealth() []EndpointHealth {
 
-	return a.sendRequest(subctx, issueRequest)
+	return a.endpoints.health()
 }
 
-func (a *Client) sendRetry(ctx context.Context, requestBuilder func() (*http.Request, error), token string) (*http.Response, error) {
+// ProbeEndpoints periodically probes the ejected endpoints
+// so they can be used again as soon as they recover, instead
+// of waiting for their ejection to expire. It blocks until
+// the given context is done.
+func (a *Client) ProbeEndpoints(ctx context.Context, interval time.Duration) {
 
 	for {
+		select {
 
-		span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.client.send")
-		defer span.Finish()
+		case <-time.After(interval):
 
-		request, err := requestBuilder()
-		if err != nil {
-			return nil, err
+			for _, e := range a.endpoints.ejected() {
+				a.probe(ctx, e)
+			}
+
+		case <-ctx.Done():
+			return
 		}
+	}
+}
+
+func (a *Client) probe(ctx context.Context, e *endpoint) {
+
+	subctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequest(http.MethodGet, e.url, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := a.httpClient.Do(request.WithContext(subctx))
+	if err != nil {
+		return
+	}
 
-		request.Close = true
+	drainBody(resp.Body)
 
-		if a.TrackingType != "" {
-			request.Header.Set("X-External-Tracking-Type", a.TrackingType)
+	if resp.StatusCode < http.StatusInternalServerError {
+		a.endpoints.success(e)
+	}
+}
+
+func (a *Client) sendRetry(ctx context.Context, requestBuilder func(string) (*http.Request, error), secrets ...string) (*http.Response, string, error) {
+
+	for attempt := 1; ; attempt++ {
+
+		e := a.endpoints.pick()
+
+		resp, err := a.send(ctx, e.url, requestBuilder, attempt, secrets)
+
+		var terr *TransportError
+		if err != nil && !errors.As(err, &terr) {
+			return nil, e.url, err
 		}
 
-		if span != nil {
-			if t := span.Tracer(); t != nil {
-				if err = t.Inject(span.Context(), opentracing.TextMap, opentracing.HTTPHeadersCarrier(request.Header)); err != nil {
-					return nil, err
-				}
-			}
+		// If the caller gave up, the error tells
+		// nothing about the health of the endpoint.
+		if terr != nil && ctx.Err() != nil {
+			terr.ctxErr = ctx.Err()
+			return nil, e.url, terr
 		}
 
-		resp, err := a.httpClient.Do(request)
-		if err == nil {
-			return resp, nil
+		failed := terr != nil || (resp.StatusCode >= http.StatusInternalServerError && a.retryPolicy.shouldRetryStatus(resp.StatusCode))
+		if failed {
+			a.endpoints.failure(e)
+		} else {
+			a.endpoints.success(e)
 		}
 
-		if uerr, ok := err.(*url.Error); ok {
-			switch uerr.Err.(type) {
-			case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError:
-				return nil, err
+		if terr != nil && !a.retryPolicy.shouldRetryClass(terr.class) {
+			return nil, e.url, terr
+		}
+
+		if terr == nil && !a.retryPolicy.shouldRetryStatus(resp.StatusCode) {
+			return resp, e.url, nil
+		}
+
+		// No more attempts are made once the caller gave up.
+		if ctx.Err() != nil || a.retryPolicy.attemptsExhausted(attempt) {
+			if terr != nil {
+				return nil, e.url, terr
 			}
+			return resp, e.url, nil
+		}
+
+		var statusCode int
+		if resp != nil {
+			statusCode = resp.StatusCode
 		}
+		a.metrics().ObserveRetry(e.url, statusCode)
 
-		err = snipToken(err, token)
-		if span != nil {
-			span.SetTag("error", true)
-			span.LogFields(log.Error(err))
+		// If the endpoint failed and another one is healthy,
+		// we fail over right away.
+		var delay time.Duration
+		if !failed || !a.endpoints.available() {
+			delay = a.retryPolicy.delay(attempt, resp)
+		}
+
+		a.log().Debug("Retrying midgard request",
+			zap.String("endpoint", e.url),
+			zap.Int("attempt", attempt),
+			zap.Int("status", statusCode),
+			zap.Duration("delay", delay),
+		)
+
+		var rerr *RequestError
+		if resp != nil {
+			rerr = newRequestError(resp, e.url)
 		}
 
 		select {
-		case <-time.After(3 * time.Second):
-			continue
-		case <-subctx.Done():
-			return nil, err
+		case <-time.After(delay):
+		case <-ctx.Done():
+			if terr != nil {
+				return nil, e.url, terr
+			}
+			if rerr.Err == nil && len(rerr.Errors) == 0 {
+				rerr.Err = fmt.Errorf("midgard responded with retryable status code %d: %w", resp.StatusCode, ctx.Err())
+			}
+			return nil, e.url, rerr
 		}
 	}
 }
 
+func (a *Client) send(ctx context.Context, baseURL string, requestBuilder func(string) (*http.Request, error), attempt int, secrets []string) (*http.Response, error) {
+
+	span, subctx := a.tracer().StartSpan(ctx, "midgardlib.client.send")
+	defer span.Finish()
+
+	span.SetTag("attempt", attempt)
+	span.SetTag("endpoint", baseURL)
+
+	request, err := requestBuilder(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	request = request.WithContext(subctx)
+
+	for key, values := range a.headers {
+		if _, ok := request.Header[key]; !ok {
+			request.Header[key] = append([]string(nil), values...)
+		}
+	}
+
+	if a.userAgent != "" {
+		request.Header.Set("User-Agent", a.userAgent)
+	}
+
+	if a.TrackingType != "" {
+		request.Header.Set("X-External-Tracking-Type", a.TrackingType)
+	}
+
+	if err = a.tracer().Inject(subctx, request.Header); err != nil {
+		return nil, err
+	}
+
+	resp, err := a.httpClient.Do(request)
+	if err != nil {
+		terr := newTransportError(err, baseURL, secrets...)
+		span.SetError(terr)
+		return nil, terr
+	}
+
+	span.SetTag("http.status_code", resp.StatusCode)
+
+	return resp, nil
+}
+
+// tracer returns the Tracer to use.
+func (a *Client) tracer() Tracer {
+
+	if a.Tracer == nil {
+		return defaultTracer
+	}
+
+	return a.Tracer
+}
+
+// log returns the logger to use.
+func (a *Client) log() *zap.Logger {
+
+	if a.logger == nil {
+		return zap.L()
+	}
+
+	return a.logger
+}
+
+// metrics returns the MetricsRecorder to use.
+func (a *Client) metrics() MetricsRecorder {
+
+	if a.Metrics == nil {
+		return noopMetricsRecorder{}
+	}
+
+	return a.Metrics
+}
+
+// drainBody reads what remains of the given response
+// body, up to a limit, and closes it so the underlying
+// connection can be reused.
+func drainBody(body io.ReadCloser) {
+
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainSize))
+	body.Close() // nolint: errcheck
+}
+
 func applyOptions(issueRequest *gaia.Issue, opts issueOpts) {
 
 	issueRequest.Quota = opts.quota
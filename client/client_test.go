@@ -18,8 +18,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -39,7 +41,7 @@ func TestClient_NewClient(t *testing.T) {
 		})
 
 		Convey("Then client url should be set", func() {
-			So(cl.url, ShouldEqual, "http://com.com")
+			So(cl.EndpointsHealth()[0].URL, ShouldEqual, "http://com.com")
 		})
 	})
 
@@ -51,6 +53,227 @@ func TestClient_NewClient(t *testing.T) {
 	})
 }
 
+func TestClient_New(t *testing.T) {
+
+	Convey("Given I create a new Client with a valid URL", t, func() {
+
+		cl, err := New("https://com.com")
+
+		Convey("Then err should be nil", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Then client should be correctly initialized", func() {
+			So(cl.EndpointsHealth()[0].URL, ShouldEqual, "https://com.com")
+			So(cl.httpClient.Timeout, ShouldEqual, 30*time.Second)
+			tlsConfig := cl.httpClient.Transport.(*http.Transport).TLSClientConfig
+			So(tlsConfig, ShouldNotBeNil)
+			So(tlsConfig.RootCAs, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given I create a new Client with invalid parameters", t, func() {
+
+		_, err1 := New("")
+		_, err2 := New("com.com")
+		_, err3 := New("http://com.com", OptClientHTTPClient(&http.Client{}), OptClientRoundTripper(&http.Transport{}))
+		_, err4 := New("http://com.com", OptClientTimeout(-1))
+		_, err5 := New("http://com.com", OptClientMaxIdleConnsPerHost(-1))
+
+		Convey("Then it should return errors", func() {
+			So(err1, ShouldNotBeNil)
+			So(err1.Error(), ShouldEqual, "missing midgard url")
+			So(err2, ShouldNotBeNil)
+			So(err2.Error(), ShouldEqual, "invalid midgard url 'com.com': missing scheme or host")
+			So(err3, ShouldNotBeNil)
+			So(err4, ShouldNotBeNil)
+			So(err5, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given I create a new Client with a custom http client", t, func() {
+
+		hc := &http.Client{Timeout: time.Minute}
+
+		cl1, _ := New("http://com.com", OptClientHTTPClient(hc))
+		cl2, _ := New("http://com.com", OptClientHTTPClient(hc), OptClientTimeout(time.Second))
+
+		Convey("Then the http client should be used", func() {
+			So(cl1.httpClient.Timeout, ShouldEqual, time.Minute)
+			So(cl2.httpClient.Timeout, ShouldEqual, time.Second)
+			So(hc.Timeout, ShouldEqual, time.Minute)
+			So(hc.CheckRedirect, ShouldBeNil)
+		})
+	})
+
+	Convey("Given I have a client with a custom http client and a server redirecting to a provider", t, func() {
+
+		var followed bool
+		provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			followed = true
+		}))
+		defer provider.Close()
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Location", provider.URL+"/auth")
+			w.WriteHeader(http.StatusFound)
+		}))
+		defer ts.Close()
+
+		cl, err := New(ts.URL, OptClientHTTPClient(&http.Client{}))
+		So(err, ShouldBeNil)
+
+		Convey("When I call IssueFromOIDCStep1", func() {
+
+			u, err := cl.IssueFromOIDCStep1(context.Background(), "/ns", "provider", "http://redirect")
+
+			Convey("Then I should get the auth URL without following it", func() {
+				So(err, ShouldBeNil)
+				So(u, ShouldEqual, provider.URL+"/auth")
+				So(followed, ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given I have a server recording the requests", t, func() {
+
+		var received *http.Request
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			fmt.Fprintln(w, `{"token": "yeay!"}`)
+		}))
+		defer ts.Close()
+
+		var roundTripped int
+		transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			roundTripped++
+			return http.DefaultTransport.RoundTrip(r)
+		})
+
+		cl, err := New(
+			ts.URL,
+			OptClientRoundTripper(transport),
+			OptClientUserAgent("my-agent/1.0"),
+			OptClientHeaders(http.Header{"X-Static": []string{"static"}, "X-External-Tracking-Type": []string{"other"}}),
+			OptClientTrackingType("test"),
+		)
+		So(err, ShouldBeNil)
+
+		Convey("When I issue a token", func() {
+
+			token, err := cl.IssueFromCertificate(context.Background(), time.Minute)
+
+			Convey("Then the request should be configured", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "yeay!")
+				So(roundTripped, ShouldEqual, 1)
+				So(received.Header.Get("User-Agent"), ShouldEqual, "my-agent/1.0")
+				So(received.Header.Get("X-Static"), ShouldEqual, "static")
+				So(received.Header.Get("X-External-Tracking-Type"), ShouldEqual, "test")
+			})
+		})
+	})
+}
+
+func TestClient_KeepAlive(t *testing.T) {
+
+	Convey("Given I have a TLS server counting the connections", t, func() {
+
+		var conns int32
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/authn" {
+				fmt.Fprintln(w, `{"claims":{"sub":"john"}}`)
+				return
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, `[{"code":503,"title":"Service Unavailable","description":"busy","subject":"midgard"}]`)
+		}))
+		ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&conns, 1)
+			}
+		}
+		ts.StartTLS()
+		defer ts.Close()
+
+		pool := x509.NewCertPool()
+		pool.AddCert(ts.Certificate())
+
+		p := DefaultRetryPolicy()
+		p.MaxAttempts = 1
+
+		Convey("When I send several requests with the default client", func() {
+
+			cl, err := New(ts.URL, OptClientTLSConfig(&tls.Config{RootCAs: pool}), OptClientRetryPolicy(p))
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 5; i++ {
+				_, err = cl.Authentify(context.Background(), "token")
+				So(err, ShouldBeNil)
+				_, err = cl.IssueFromCertificate(context.Background(), time.Minute)
+				So(err, ShouldNotBeNil)
+			}
+
+			Convey("Then a single connection should be used", func() {
+				So(atomic.LoadInt32(&conns), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I send several requests with keep-alives disabled", func() {
+
+			cl, err := New(ts.URL, OptClientTLSConfig(&tls.Config{RootCAs: pool}), OptClientDisableKeepAlives())
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 5; i++ {
+				_, err = cl.Authentify(context.Background(), "token")
+				So(err, ShouldBeNil)
+			}
+
+			Convey("Then a connection should be used for each request", func() {
+				So(atomic.LoadInt32(&conns), ShouldEqual, 5)
+			})
+		})
+	})
+}
+
+func BenchmarkClient_Authentify(b *testing.B) {
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"claims":{"sub":"john","data":{"commonName":"john"}}}`)
+	}))
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	run := func(b *testing.B, options ...ClientOption) {
+
+		cl, err := New(ts.URL, append(options, OptClientTLSConfig(&tls.Config{RootCAs: pool}))...)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := cl.Authentify(context.Background(), "token"); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+
+	b.Run("keepalive", func(b *testing.B) { run(b) })
+	b.Run("close", func(b *testing.B) { run(b, OptClientDisableKeepAlives()) })
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
 func TestClient_Authentify(t *testing.T) {
 
 	Convey("Given I have a Client and some valid http header", t, func() {
@@ -189,6 +412,249 @@ func TestClient_Authentify(t *testing.T) {
 	})
 }
 
+func TestClient_AuthentifyClaims(t *testing.T) {
+
+	Convey("Given I have a client and a server returning full claims", t, func() {
+
+		var called int32
+		exp := time.Now().Add(time.Hour).Unix()
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			authn := gaia.NewAuthn()
+			_ = json.NewDecoder(r.Body).Decode(authn)
+			if authn.Token != "good" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"claims":{
+				"sub":"john",
+				"iss":"midgard",
+				"aud":"aporeto",
+				"exp":%d,
+				"realm":"certificate",
+				"data":{"commonName":"john"},
+				"restrictions":{"namespace":"/a","perms":["@auth:role=viewer"]}
+			}}`, exp)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		Convey("When I call AuthentifyClaims with a valid token", func() {
+
+			claims, err := cl.AuthentifyClaims(context.Background(), "good")
+
+			Convey("Then err should be nil", func() {
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Then the full claims should be returned", func() {
+				So(claims.Subject(), ShouldEqual, "john")
+				So(claims.Realm(), ShouldEqual, "certificate")
+				So(claims.MidgardClaims().Issuer, ShouldEqual, "midgard")
+				So(claims.MidgardClaims().Audience, ShouldEqual, "aporeto")
+				So(claims.ExpiresAt().Unix(), ShouldEqual, exp)
+				So(claims.Tags(), ShouldResemble, []string{"@auth:commonname=john", "@auth:subject=john"})
+
+				r := claims.Restrictions()
+				So(r.Namespace, ShouldEqual, "/a")
+				So(r.Permissions, ShouldResemble, []string{"@auth:role=viewer"})
+			})
+		})
+
+		Convey("When I call AuthentifyClaims with an invalid token", func() {
+
+			claims, err := cl.AuthentifyClaims(context.Background(), "bad")
+
+			Convey("Then err should be unauthorized", func() {
+				So(claims, ShouldBeNil)
+				So(IsUnauthorized(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("When I call AuthentifyClaims and Authentify with a cache", func() {
+
+			cl.AuthentifyCache = NewAuthentifyCache(10, time.Minute, 0)
+
+			_, err1 := cl.Authentify(context.Background(), "good")
+			claims, err2 := cl.AuthentifyClaims(context.Background(), "good")
+
+			Convey("Then the full claims should be returned from the cache", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(claims.Subject(), ShouldEqual, "john")
+				So(claims.MidgardClaims().Issuer, ShouldEqual, "midgard")
+				So(atomic.LoadInt32(&called), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestClient_Revoke(t *testing.T) {
+
+	Convey("Given I have a client with a cache and a server revoking tokens", t, func() {
+
+		var revoked string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/authn":
+				authn := gaia.NewAuthn()
+				_ = json.NewDecoder(r.Body).Decode(authn)
+				if authn.Token == revoked {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprintln(w, `{"claims":{"sub":"john"}}`)
+			case "/revoke":
+				req := &revocationRequest{}
+				_ = json.NewDecoder(r.Body).Decode(req)
+				if req.Token == "unknown" {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprintln(w, `[{"code":404,"title":"Not Found","description":"no such token","subject":"midgard"}]`)
+					return
+				}
+				revoked = req.Token
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+		cl.AuthentifyCache = NewAuthentifyCache(10, time.Minute, 0)
+
+		Convey("When I revoke a cached token", func() {
+
+			_, err := cl.Authentify(context.Background(), "thetoken")
+			So(err, ShouldBeNil)
+
+			err = cl.Revoke(context.Background(), "thetoken")
+
+			Convey("Then err should be nil", func() {
+				So(err, ShouldBeNil)
+				So(revoked, ShouldEqual, "thetoken")
+			})
+
+			Convey("Then the token should not be accepted anymore", func() {
+				_, err := cl.Authentify(context.Background(), "thetoken")
+				So(IsUnauthorized(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("When I revoke an unknown token", func() {
+
+			err := cl.Revoke(context.Background(), "unknown")
+
+			Convey("Then err should be a RequestError", func() {
+				var rerr *RequestError
+				So(errors.As(err, &rerr), ShouldBeTrue)
+				So(rerr.StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+		})
+	})
+
+	Convey("Given I have a client with a cache and a token authentified while revoking", t, func() {
+
+		var cl *Client
+		var revoked bool
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/authn":
+				if revoked {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprintln(w, `{"claims":{"sub":"john"}}`)
+			case "/revoke":
+				_, _ = cl.Authentify(r.Context(), "thetoken")
+				revoked = true
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+		defer ts.Close()
+
+		cl = NewClient(ts.URL)
+		cl.AuthentifyCache = NewAuthentifyCache(10, time.Minute, 0)
+
+		Convey("When I revoke the token", func() {
+
+			err := cl.Revoke(context.Background(), "thetoken")
+
+			Convey("Then the token should not be accepted anymore", func() {
+				So(err, ShouldBeNil)
+				_, err := cl.Authentify(context.Background(), "thetoken")
+				So(IsUnauthorized(err), ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("Given I have a client with a cache and a token authentified before revoking", t, func() {
+
+		var revoked int32
+		authnStarted := make(chan struct{})
+		authnRelease := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/authn":
+				if atomic.LoadInt32(&revoked) == 1 {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				close(authnStarted)
+				<-authnRelease
+				fmt.Fprintln(w, `{"claims":{"sub":"john"}}`)
+			case "/revoke":
+				atomic.StoreInt32(&revoked, 1)
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+		cl.AuthentifyCache = NewAuthentifyCache(10, time.Minute, 0)
+
+		Convey("When the Authentify completes after the revocation", func() {
+
+			authnErr := make(chan error)
+			go func() {
+				_, err := cl.Authentify(context.Background(), "thetoken")
+				authnErr <- err
+			}()
+
+			<-authnStarted
+			err := cl.Revoke(context.Background(), "thetoken")
+			close(authnRelease)
+			So(<-authnErr, ShouldBeNil)
+
+			Convey("Then the token should not be accepted anymore", func() {
+				So(err, ShouldBeNil)
+				_, err := cl.Authentify(context.Background(), "thetoken")
+				So(IsUnauthorized(err), ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("Given I have a client with an unreachable server", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		ts.Close()
+
+		p := DefaultRetryPolicy()
+		p.MaxAttempts = 1
+		cl := NewClientWithRetryPolicy(ts.URL, &tls.Config{}, p)
+
+		Convey("When I revoke a token", func() {
+
+			err := cl.Revoke(context.Background(), "thetoken")
+
+			Convey("Then err should be a transient TransportError", func() {
+				var terr *TransportError
+				So(errors.As(err, &terr), ShouldBeTrue)
+				So(IsTransient(err), ShouldBeTrue)
+			})
+		})
+	})
+}
+
 func TestClient_IssueFromGoogle(t *testing.T) {
 
 	Convey("Given I have a client and a fake working server", t, func() {
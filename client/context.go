@@ -0,0 +1,73 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+
+	"go.aporeto.io/gaia/types"
+)
+
+type contextKey struct{}
+
+type authInfo struct {
+	token         string
+	claims        []string
+	midgardClaims *types.MidgardClaims
+}
+
+// ContextWithAuth returns a copy of the given context holding the given
+// token, its normalized claims and, if available, its MidgardClaims.
+func ContextWithAuth(ctx context.Context, token string, claims []string, midgardClaims *types.MidgardClaims) context.Context {
+
+	return context.WithValue(ctx, contextKey{}, &authInfo{
+		token:         token,
+		claims:        claims,
+		midgardClaims: midgardClaims,
+	})
+}
+
+// TokenFromContext returns the token stored in the given
+// context by an authentication middleware or interceptor.
+func TokenFromContext(ctx context.Context) (string, bool) {
+
+	info, ok := ctx.Value(contextKey{}).(*authInfo)
+	if !ok {
+		return "", false
+	}
+
+	return info.token, true
+}
+
+// ClaimsFromContext returns the normalized claims stored in the
+// given context by an authentication middleware or interceptor.
+func ClaimsFromContext(ctx context.Context) ([]string, bool) {
+
+	info, ok := ctx.Value(contextKey{}).(*authInfo)
+	if !ok {
+		return nil, false
+	}
+
+	return info.claims, true
+}
+
+// MidgardClaimsFromContext returns the MidgardClaims stored in the
+// given context by an authentication middleware or interceptor.
+func MidgardClaimsFromContext(ctx context.Context) (*types.MidgardClaims, bool) {
+
+	info, ok := ctx.Value(contextKey{}).(*authInfo)
+	if !ok || info.midgardClaims == nil {
+		return nil, false
+	}
+
+	return info.midgardClaims, true
+}
@@ -0,0 +1,415 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"go.aporeto.io/gaia"
+	"go.uber.org/zap"
+)
+
+type credentialsWatcherOpts struct {
+	pollInterval time.Duration
+}
+
+// A CredentialsWatcherOption is the type of various options
+// you can pass to the credentials watchers.
+type CredentialsWatcherOption func(*credentialsWatcherOpts)
+
+// OptCredentialsWatcherPollInterval sets the interval at which
+// the credentials files are checked for changes by Run.
+// The default is 10s.
+func OptCredentialsWatcherPollInterval(interval time.Duration) CredentialsWatcherOption {
+
+	return func(opts *credentialsWatcherOpts) {
+		opts.pollInterval = interval
+	}
+}
+
+// credentialsMaterial contains the TLS material loaded from credentials files.
+type credentialsMaterial struct {
+	creds      *gaia.Credential
+	cert       tls.Certificate
+	rootCAs    *x509.CertPool
+	clientCAs  *x509.CertPool
+	hasCAsData bool
+}
+
+// A CredentialsWatcher loads credentials from files and reloads them when
+// the files change, so long running processes can use rotated credentials
+// without restarting. The files are checked on Reload and periodically if
+// Run is started.
+//
+// The tls.Configs returned by ClientTLSConfig and ServerTLSConfig always
+// use the last loaded certificate and trust the last loaded ca.
+// The subscribers are notified after each reload.
+type CredentialsWatcher struct {
+	paths []string
+	load  func([][]byte) (credentialsMaterial, error)
+	opts  credentialsWatcherOpts
+
+	data        [][]byte
+	material    credentialsMaterial
+	subscribers []chan struct{}
+	lock        sync.RWMutex
+}
+
+// NewCredentialsWatcher returns a CredentialsWatcher of
+// the JSON encoded gaia.Credential at the given path.
+//
+// Tokens issued from the certificate are not reissued on reload: use
+// tokenmanager.NewX509TokenManagerFromWatcher, or pass OptReissueOn
+// with a channel returned by Subscribe to the token manager.
+func NewCredentialsWatcher(path string, options ...CredentialsWatcherOption) (*CredentialsWatcher, error) {
+
+	load := func(data [][]byte) (credentialsMaterial, error) {
+
+		creds := &gaia.Credential{}
+		if err := json.Unmarshal(data[0], creds); err != nil {
+			return credentialsMaterial{}, fmt.Errorf("unable to decode app credential: %s", err)
+		}
+
+		caData, certData, keyData, err := credsToPEM(creds)
+		if err != nil {
+			return credentialsMaterial{}, err
+		}
+
+		m, err := loadCredentialsMaterial(caData, certData, keyData)
+		if err != nil {
+			return credentialsMaterial{}, err
+		}
+
+		m.creds = creds
+
+		return m, nil
+	}
+
+	return newCredentialsWatcher([]string{path}, load, options)
+}
+
+// NewPEMCredentialsWatcher returns a CredentialsWatcher of the PEM
+// encoded certificate, key and ca at the given paths. The caPath
+// is optional.
+func NewPEMCredentialsWatcher(certPath string, keyPath string, caPath string, options ...CredentialsWatcherOption) (*CredentialsWatcher, error) {
+
+	paths := []string{certPath, keyPath}
+	if caPath != "" {
+		paths = append(paths, caPath)
+	}
+
+	load := func(data [][]byte) (credentialsMaterial, error) {
+
+		var caData []byte
+		if len(data) > 2 {
+			caData = data[2]
+		}
+
+		return loadCredentialsMaterial(caData, data[0], data[1])
+	}
+
+	return newCredentialsWatcher(paths, load, options)
+}
+
+func newCredentialsWatcher(paths []string, load func([][]byte) (credentialsMaterial, error), options []CredentialsWatcherOption) (*CredentialsWatcher, error) {
+
+	opts := credentialsWatcherOpts{
+		pollInterval: 10 * time.Second,
+	}
+
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	w := &CredentialsWatcher{
+		paths: paths,
+		load:  load,
+		opts:  opts,
+	}
+
+	if _, err := w.Reload(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Reload reloads the credentials if the files changed since the last
+// successful load. It returns true if the credentials were reloaded.
+// If the new credentials are invalid, the current ones are kept.
+func (w *CredentialsWatcher) Reload() (bool, error) {
+
+	data := make([][]byte, len(w.paths))
+	for i, path := range w.paths {
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, fmt.Errorf("unable to read credentials file: %w", err)
+		}
+		data[i] = d
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if equalCredentialsData(w.data, data) {
+		return false, nil
+	}
+
+	m, err := w.load(data)
+	if err != nil {
+		return false, err
+	}
+
+	w.data = data
+	w.material = m
+
+	for _, ch := range w.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+
+	return true, nil
+}
+
+// Run reloads the credentials periodically
+// until the given context is done.
+func (w *CredentialsWatcher) Run(ctx context.Context) {
+
+	for {
+
+		select {
+
+		case <-time.After(w.opts.pollInterval):
+
+			reloaded, err := w.Reload()
+			if err != nil {
+				zap.L().Error("Unable to reload credentials", zap.Strings("paths", w.paths), zap.Error(err))
+				break
+			}
+
+			if reloaded {
+				zap.L().Info("Credentials reloaded", zap.Strings("paths", w.paths))
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Subscribe returns a channel receiving a value each time the
+// credentials are reloaded. Reloads happening while a value is
+// pending are coalesced.
+func (w *CredentialsWatcher) Subscribe() <-chan struct{} {
+
+	ch := make(chan struct{}, 1)
+
+	w.lock.Lock()
+	w.subscribers = append(w.subscribers, ch)
+	w.lock.Unlock()
+
+	return ch
+}
+
+// Credential returns the last loaded gaia.Credential. It
+// returns nil if the watcher loads PEM encoded files.
+func (w *CredentialsWatcher) Credential() *gaia.Credential {
+
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	return w.material.creds
+}
+
+// Certificate returns the last loaded certificate.
+func (w *CredentialsWatcher) Certificate() *tls.Certificate {
+
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	cert := w.material.cert
+
+	return &cert
+}
+
+// ClientTLSConfig returns a tls.Config presenting the last loaded
+// certificate through GetClientCertificate, and verifying the
+// certificate of the server with the given name against the system
+// CAs and the last loaded ca.
+//
+// As the root CAs of a tls.Config cannot change, the verification
+// is done by VerifyPeerCertificate and InsecureSkipVerify is set.
+// Do not unset it nor replace VerifyPeerCertificate.
+func (w *CredentialsWatcher) ClientTLSConfig(serverName string) *tls.Config {
+
+	if serverName == "" {
+		panic("serverName cannot be empty")
+	}
+
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return w.Certificate(), nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return w.verifyServerCertificate(serverName, rawCerts)
+		},
+	}
+}
+
+// verifyServerCertificate verifies the given raw certificate chain
+// for the given server name against the last loaded root CAs.
+func (w *CredentialsWatcher) verifyServerCertificate(serverName string, rawCerts [][]byte) error {
+
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("missing server certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("unable to parse server certificate: %s", err)
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	w.lock.RLock()
+	rootCAs := w.material.rootCAs
+	w.lock.RUnlock()
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         rootCAs,
+		Intermediates: intermediates,
+	})
+
+	return err
+}
+
+// ServerTLSConfig returns a tls.Config derived from the given one, which
+// can be nil, presenting the last loaded certificate and trusting the
+// last loaded ca, if any, for client certificates through
+// GetConfigForClient.
+func (w *CredentialsWatcher) ServerTLSConfig(base *tls.Config) *tls.Config {
+
+	if base == nil {
+		base = &tls.Config{}
+	}
+
+	base = base.Clone()
+
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return w.Certificate(), nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+
+			w.lock.RLock()
+			defer w.lock.RUnlock()
+
+			cfg := base.Clone()
+			cfg.Certificates = []tls.Certificate{w.material.cert}
+			if w.material.hasCAsData {
+				cfg.ClientCAs = w.material.clientCAs
+			}
+
+			return cfg, nil
+		},
+	}
+}
+
+// loadCredentialsMaterial returns the credentialsMaterial from the
+// given PEM encoded ca, certificate and key.
+func loadCredentialsMaterial(caData []byte, certData []byte, keyData []byte) (credentialsMaterial, error) {
+
+	cert, rootCAs, err := pemToTLSMaterial(caData, certData, keyData)
+	if err != nil {
+		return credentialsMaterial{}, err
+	}
+
+	// The files may be read while they are being rotated.
+	if err := matchKeyPair(cert); err != nil {
+		return credentialsMaterial{}, err
+	}
+
+	clientCAs := x509.NewCertPool()
+
+	return credentialsMaterial{
+		cert:       cert,
+		rootCAs:    rootCAs,
+		clientCAs:  clientCAs,
+		hasCAsData: clientCAs.AppendCertsFromPEM(caData),
+	}, nil
+}
+
+// matchKeyPair returns an error if the private key of the
+// given certificate does not match its public key.
+func matchKeyPair(cert tls.Certificate) error {
+
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok || len(cert.Certificate) == 0 {
+		return nil
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("unable to parse certificate: %s", err)
+		}
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return fmt.Errorf("unable to encode public key: %s", err)
+	}
+
+	if !bytes.Equal(pub, leaf.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("private key does not match certificate")
+	}
+
+	return nil
+}
+
+// equalCredentialsData returns true if the given files contents are equal.
+func equalCredentialsData(a [][]byte, b [][]byte) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
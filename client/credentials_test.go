@@ -0,0 +1,323 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func makeTestCertificate(cn string, parent *testCertificate) *testCertificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		panic(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(path string, data []byte) {
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		panic(err)
+	}
+}
+
+func TestCredentialsWatcher_PEM(t *testing.T) {
+
+	Convey("Given I have PEM credentials files", t, func() {
+
+		dir, err := ioutil.TempDir("", "credentials")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint: errcheck
+
+		ca := makeTestCertificate("ca", nil)
+		a := makeTestCertificate("a", ca)
+		b := makeTestCertificate("b", ca)
+
+		certPath := filepath.Join(dir, "cert.pem")
+		keyPath := filepath.Join(dir, "key.pem")
+		caPath := filepath.Join(dir, "ca.pem")
+
+		writeTestFile(certPath, a.certPEM)
+		writeTestFile(keyPath, a.keyPEM)
+		writeTestFile(caPath, ca.certPEM)
+
+		Convey("When I create a watcher on missing files", func() {
+
+			_, err := NewPEMCredentialsWatcher(filepath.Join(dir, "missing.pem"), keyPath, "")
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I create a watcher", func() {
+
+			w, err := NewPEMCredentialsWatcher(certPath, keyPath, caPath)
+			So(err, ShouldBeNil)
+
+			events := w.Subscribe()
+
+			Convey("Then the certificate should be loaded", func() {
+				So(w.Certificate().Certificate[0], ShouldResemble, a.cert.Raw)
+				So(w.Credential(), ShouldBeNil)
+			})
+
+			Convey("Then reloading unchanged files should do nothing", func() {
+				reloaded, err := w.Reload()
+				So(err, ShouldBeNil)
+				So(reloaded, ShouldBeFalse)
+				So(len(events), ShouldEqual, 0)
+			})
+
+			Convey("Then reloading rotated files should swap the certificate", func() {
+
+				writeTestFile(certPath, b.certPEM)
+				writeTestFile(keyPath, b.keyPEM)
+
+				reloaded, err := w.Reload()
+				So(err, ShouldBeNil)
+				So(reloaded, ShouldBeTrue)
+				So(w.Certificate().Certificate[0], ShouldResemble, b.cert.Raw)
+				So(len(events), ShouldEqual, 1)
+			})
+
+			Convey("Then reloading a mismatched key pair should keep the certificate", func() {
+
+				writeTestFile(certPath, b.certPEM)
+
+				reloaded, err := w.Reload()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "private key does not match certificate")
+				So(reloaded, ShouldBeFalse)
+				So(w.Certificate().Certificate[0], ShouldResemble, a.cert.Raw)
+				So(len(events), ShouldEqual, 0)
+			})
+
+			Convey("Then the tls configs should use the rotated certificates", func() {
+
+				var peer string
+				ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					peer = r.TLS.PeerCertificates[0].Subject.CommonName
+				}))
+				ts.TLS = w.ServerTLSConfig(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert})
+				ts.StartTLS()
+				defer ts.Close()
+
+				transport := &http.Transport{TLSClientConfig: w.ClientTLSConfig("127.0.0.1")}
+				cl := &http.Client{Transport: transport}
+
+				resp, err := cl.Get(ts.URL)
+				So(err, ShouldBeNil)
+				So(resp.TLS.PeerCertificates[0].Subject.CommonName, ShouldEqual, "a")
+				So(peer, ShouldEqual, "a")
+				resp.Body.Close() // nolint: errcheck
+
+				writeTestFile(certPath, b.certPEM)
+				writeTestFile(keyPath, b.keyPEM)
+				_, err = w.Reload()
+				So(err, ShouldBeNil)
+
+				transport.CloseIdleConnections()
+
+				resp, err = cl.Get(ts.URL)
+				So(err, ShouldBeNil)
+				So(resp.TLS.PeerCertificates[0].Subject.CommonName, ShouldEqual, "b")
+				So(peer, ShouldEqual, "b")
+				resp.Body.Close() // nolint: errcheck
+			})
+
+			Convey("Then the client tls config should trust the rotated ca", func() {
+
+				ca2 := makeTestCertificate("ca2", nil)
+				c := makeTestCertificate("c", ca2)
+
+				serverCert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+				So(err, ShouldBeNil)
+
+				ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+				ts.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+				ts.StartTLS()
+				defer ts.Close()
+
+				transport := &http.Transport{TLSClientConfig: w.ClientTLSConfig("127.0.0.1")}
+				cl := &http.Client{Transport: transport}
+
+				_, err = cl.Get(ts.URL)
+				So(err, ShouldNotBeNil)
+				var uerr x509.UnknownAuthorityError
+				So(errors.As(err, &uerr), ShouldBeTrue)
+
+				writeTestFile(certPath, c.certPEM)
+				writeTestFile(keyPath, c.keyPEM)
+				writeTestFile(caPath, ca2.certPEM)
+				_, err = w.Reload()
+				So(err, ShouldBeNil)
+
+				resp, err := cl.Get(ts.URL)
+				So(err, ShouldBeNil)
+				resp.Body.Close() // nolint: errcheck
+			})
+
+			Convey("Then the client tls config should verify the server name", func() {
+
+				serverCert, err := tls.X509KeyPair(b.certPEM, b.keyPEM)
+				So(err, ShouldBeNil)
+
+				ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+				ts.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+				ts.StartTLS()
+				defer ts.Close()
+
+				cl := &http.Client{Transport: &http.Transport{TLSClientConfig: w.ClientTLSConfig("midgard")}}
+
+				_, err = cl.Get(ts.URL)
+				So(err, ShouldNotBeNil)
+				var herr x509.HostnameError
+				So(errors.As(err, &herr), ShouldBeTrue)
+				So(herr.Host, ShouldEqual, "midgard")
+			})
+
+			Convey("Then the client tls config should require a server name", func() {
+				So(func() { w.ClientTLSConfig("") }, ShouldPanicWith, "serverName cannot be empty")
+			})
+		})
+	})
+}
+
+func TestCredentialsWatcher_Credential(t *testing.T) {
+
+	Convey("Given I have a credential file", t, func() {
+
+		dir, err := ioutil.TempDir("", "credentials")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint: errcheck
+
+		ca := makeTestCertificate("ca", nil)
+		a := makeTestCertificate("a", ca)
+
+		data, err := json.Marshal(&gaia.Credential{
+			APIURL:               "https://api",
+			Name:                 "app",
+			CertificateAuthority: base64.StdEncoding.EncodeToString(ca.certPEM),
+			Certificate:          base64.StdEncoding.EncodeToString(a.certPEM),
+			CertificateKey:       base64.StdEncoding.EncodeToString(a.keyPEM),
+		})
+		So(err, ShouldBeNil)
+
+		path := filepath.Join(dir, "creds.json")
+		writeTestFile(path, data)
+
+		Convey("When I create a watcher", func() {
+
+			w, err := NewCredentialsWatcher(path)
+
+			Convey("Then the credential should be loaded", func() {
+				So(err, ShouldBeNil)
+				So(w.Credential().APIURL, ShouldEqual, "https://api")
+				So(w.Certificate().Certificate[0], ShouldResemble, a.cert.Raw)
+			})
+
+			Convey("Then the client tls config should present the certificate", func() {
+				cert, err := w.ClientTLSConfig("127.0.0.1").GetClientCertificate(&tls.CertificateRequestInfo{})
+				So(err, ShouldBeNil)
+				So(cert.Certificate[0], ShouldResemble, a.cert.Raw)
+			})
+
+			Convey("Then the server tls config should trust the ca", func() {
+				cfg, err := w.ServerTLSConfig(nil).GetConfigForClient(&tls.ClientHelloInfo{})
+				So(err, ShouldBeNil)
+				So(cfg.Certificates[0].Certificate[0], ShouldResemble, a.cert.Raw)
+				So(cfg.ClientCAs.Subjects(), ShouldResemble, [][]byte{ca.cert.RawSubject})
+			})
+		})
+
+		Convey("When I create a watcher on an invalid file", func() {
+
+			writeTestFile(path, []byte("not json"))
+
+			_, err := NewCredentialsWatcher(path)
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "unable to decode app credential")
+			})
+		})
+	})
+}
@@ -0,0 +1,205 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.aporeto.io/gaia"
+)
+
+// Downscope issues a child token of the given parent token with
+// IssueFromAporetoIdentityToken, restricted to the given options.
+//
+// Before sending the request, it checks that the requested restrictions
+// are a subset of the restrictions of the parent token, and inherits the
+// ones that are not requested. The validity given with OptValidity is
+// capped to the remaining lifetime of the parent token. Without it, the
+// child token lives as long as the parent, which must then expire.
+// Requests that would widen the parent token are rejected with an
+// IssueValidationError.
+//
+// It returns the child token and its effective restrictions.
+func (a *Client) Downscope(ctx context.Context, parentToken string, options ...Option) (string, Restrictions, error) {
+
+	parent, err := UnsecureTypedClaimsFromToken(parentToken)
+	if err != nil {
+		return "", Restrictions{}, fmt.Errorf("unable to parse parent token: %w", err)
+	}
+
+	parentRestrictions := parent.Restrictions()
+
+	opts := issueOpts{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	// OptValidity is consumed here, as the
+	// other issue methods reject it.
+	validity := opts.validity
+	opts.validity = 0
+
+	problems := validateIssueOpts(opts)
+	if validity < 0 {
+		problems = append(problems, IssueValidationProblem{Field: "validity", Reason: "must be a positive duration"})
+	}
+
+	if exp := parent.ExpiresAt(); !exp.IsZero() {
+		remaining := time.Until(exp).Truncate(time.Second)
+		if remaining <= 0 {
+			problems = append(problems, IssueValidationProblem{Field: "token", Reason: "parent token is expired"})
+		} else if validity == 0 || validity > remaining {
+			validity = remaining
+		}
+	} else if validity == 0 {
+		problems = append(problems, IssueValidationProblem{Field: "validity", Reason: "must be set as the parent token does not expire"})
+	}
+
+	var restrictions Restrictions
+	if len(problems) == 0 {
+		restrictions, problems = intersectRestrictions(parentRestrictions, Restrictions{
+			Namespace:   opts.restrictedNamespace,
+			Permissions: opts.restrictedPermissions,
+			Networks:    opts.restrictedNetworks,
+		})
+	}
+
+	if len(problems) > 0 {
+		return "", Restrictions{}, &IssueValidationError{Realm: string(gaia.IssueRealmAporetoIdentityToken), Problems: problems}
+	}
+
+	options = append(
+		append([]Option(nil), options...),
+		OptRestrictNamespace(restrictions.Namespace),
+		OptRestrictPermissions(restrictions.Permissions),
+		OptRestrictNetworks(restrictions.Networks),
+		OptValidity(0),
+	)
+
+	token, err := a.IssueFromAporetoIdentityToken(ctx, parentToken, validity, options...)
+	if err != nil {
+		return "", Restrictions{}, err
+	}
+
+	return token, restrictions, nil
+}
+
+// intersectRestrictions returns the restrictions of a token derived from
+// a token with the parent restrictions, when asking for the requested
+// ones. The restrictions that are not requested are inherited from the
+// parent. It returns the problems found if the requested restrictions are
+// not a subset of the parent ones.
+func intersectRestrictions(parent Restrictions, requested Restrictions) (Restrictions, []IssueValidationProblem) {
+
+	var problems []IssueValidationProblem
+
+	out := parent
+
+	if requested.Namespace != "" {
+		if !parent.AllowsNamespace(requested.Namespace) {
+			problems = append(problems, IssueValidationProblem{
+				Field:  "restrictedNamespace",
+				Reason: fmt.Sprintf("'%s' is not within the parent namespace '%s'", requested.Namespace, parent.Namespace),
+			})
+		}
+		out.Namespace = requested.Namespace
+	}
+
+	if len(requested.Permissions) > 0 {
+		for i, permission := range requested.Permissions {
+			if !parent.allowsRestrictedPermission(permission) {
+				problems = append(problems, IssueValidationProblem{
+					Field:  fmt.Sprintf("restrictedPermissions[%d]", i),
+					Reason: fmt.Sprintf("'%s' is not allowed by the parent permissions", permission),
+				})
+			}
+		}
+		out.Permissions = requested.Permissions
+	}
+
+	if len(requested.Networks) > 0 {
+		for i, network := range requested.Networks {
+			if !parent.allowsNetwork(network) {
+				problems = append(problems, IssueValidationProblem{
+					Field:  fmt.Sprintf("restrictedNetworks[%d]", i),
+					Reason: fmt.Sprintf("'%s' is not within the parent networks", network),
+				})
+			}
+		}
+		out.Networks = requested.Networks
+	}
+
+	return out, problems
+}
+
+// allowsRestrictedPermission returns true if the given restricted
+// permission is covered by the permissions of the restrictions. Tags
+// must be present as is in the restrictions.
+func (r Restrictions) allowsRestrictedPermission(permission string) bool {
+
+	if len(r.Permissions) == 0 {
+		return true
+	}
+
+	if strings.HasPrefix(permission, "@") {
+		for _, p := range r.Permissions {
+			if p == permission {
+				return true
+			}
+		}
+		return false
+	}
+
+	parts := strings.Split(permission, ",")
+	for _, op := range parts[1:] {
+		if !r.AllowsPermission(parts[0], op) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allowsNetwork returns true if the given CIDR is
+// within one of the networks of the restrictions.
+func (r Restrictions) allowsNetwork(network string) bool {
+
+	if len(r.Networks) == 0 {
+		return true
+	}
+
+	_, child, err := net.ParseCIDR(network)
+	if err != nil {
+		return false
+	}
+
+	childOnes, childBits := child.Mask.Size()
+
+	for _, n := range r.Networks {
+
+		_, parent, err := net.ParseCIDR(n)
+		if err != nil {
+			continue
+		}
+
+		ones, bits := parent.Mask.Size()
+		if bits == childBits && ones <= childOnes && parent.Contains(child.IP) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,226 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia"
+	"go.aporeto.io/gaia/types"
+)
+
+func TestClient_Downscope(t *testing.T) {
+
+	Convey("Given I have a client and a restricted parent token", t, func() {
+
+		var issue *gaia.Issue
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			issue = gaia.NewIssue()
+			_ = json.NewDecoder(r.Body).Decode(issue)
+			issue.Token = "child"
+			_ = json.NewEncoder(w).Encode(issue)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		parent := makeTokenWithKID(&types.MidgardClaims{
+			Realm: "certificate",
+			Restrictions: &types.MidgardClaimsRestrictions{
+				Namespace:   "/a",
+				Permissions: []string{"processingunit,get,post", "@auth:role=viewer"},
+				Networks:    []string{"10.0.0.0/8"},
+			},
+			StandardClaims: jwt.StandardClaims{
+				Subject:   "john",
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			},
+		}, "", key(signerKey))
+
+		Convey("When I downscope it without options", func() {
+
+			token, r, err := cl.Downscope(context.Background(), parent)
+
+			Convey("Then the child token should inherit the parent restrictions", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "child")
+				So(r, ShouldResemble, Restrictions{
+					Namespace:   "/a",
+					Permissions: []string{"processingunit,get,post", "@auth:role=viewer"},
+					Networks:    []string{"10.0.0.0/8"},
+				})
+				So(issue.Realm, ShouldEqual, gaia.IssueRealmAporetoIdentityToken)
+				So(issue.RestrictedNamespace, ShouldEqual, "/a")
+				So(issue.RestrictedNetworks, ShouldResemble, []string{"10.0.0.0/8"})
+			})
+
+			Convey("Then the validity should be the remaining lifetime of the parent", func() {
+				d, err := time.ParseDuration(issue.Validity)
+				So(err, ShouldBeNil)
+				So(d, ShouldBeBetweenOrEqual, 59*time.Minute, time.Hour)
+			})
+		})
+
+		Convey("When I downscope it with narrower restrictions and a longer validity", func() {
+
+			_, r, err := cl.Downscope(
+				context.Background(),
+				parent,
+				OptValidity(2*time.Hour),
+				OptRestrictNamespace("/a/b"),
+				OptRestrictPermissions([]string{"processingunit,get", "@auth:role=viewer"}),
+				OptRestrictNetworks([]string{"10.1.0.0/16"}),
+			)
+
+			Convey("Then the child token should have the requested restrictions", func() {
+				So(err, ShouldBeNil)
+				So(r, ShouldResemble, Restrictions{
+					Namespace:   "/a/b",
+					Permissions: []string{"processingunit,get", "@auth:role=viewer"},
+					Networks:    []string{"10.1.0.0/16"},
+				})
+				So(issue.RestrictedNamespace, ShouldEqual, "/a/b")
+			})
+
+			Convey("Then the validity should be capped", func() {
+				d, err := time.ParseDuration(issue.Validity)
+				So(err, ShouldBeNil)
+				So(d, ShouldBeLessThanOrEqualTo, time.Hour)
+			})
+		})
+
+		Convey("When I downscope it with an options slice with spare capacity", func() {
+
+			options := make([]Option, 1, 10)
+			options[0] = OptValidity(time.Minute)
+
+			_, _, err := cl.Downscope(context.Background(), parent, options...)
+
+			Convey("Then the options slice should not have been modified", func() {
+				So(err, ShouldBeNil)
+				So(options[:cap(options)][1], ShouldBeNil)
+			})
+		})
+
+		Convey("When I downscope it with wider restrictions", func() {
+
+			issue = nil
+
+			_, _, err := cl.Downscope(
+				context.Background(),
+				parent,
+				OptValidity(time.Minute),
+				OptRestrictNamespace("/b"),
+				OptRestrictPermissions([]string{"processingunit,delete", "*,get", "@auth:role=admin"}),
+				OptRestrictNetworks([]string{"0.0.0.0/0"}),
+			)
+
+			Convey("Then I should get a validation error", func() {
+				var verr *IssueValidationError
+				So(errors.As(err, &verr), ShouldBeTrue)
+				So(verr.Realm, ShouldEqual, string(gaia.IssueRealmAporetoIdentityToken))
+				So(len(verr.Problems), ShouldEqual, 5)
+				So(verr.Problems[0].Field, ShouldEqual, "restrictedNamespace")
+				So(verr.Problems[1].Field, ShouldEqual, "restrictedPermissions[0]")
+				So(verr.Problems[4].Field, ShouldEqual, "restrictedNetworks[0]")
+			})
+
+			Convey("Then no request should have been sent", func() {
+				So(issue, ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given I have a client and an expired parent token", t, func() {
+
+		cl := NewClient("https://midgard")
+
+		parent := makeTokenWithKID(&types.MidgardClaims{
+			Realm:          "certificate",
+			StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Hour).Unix()},
+		}, "", key(signerKey))
+
+		Convey("When I downscope it", func() {
+
+			_, _, err := cl.Downscope(context.Background(), parent, OptValidity(time.Minute))
+
+			Convey("Then I should get a validation error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "parent token is expired")
+			})
+		})
+	})
+
+	Convey("Given I have a client and a parent token that does not expire", t, func() {
+
+		var issue *gaia.Issue
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			issue = gaia.NewIssue()
+			_ = json.NewDecoder(r.Body).Decode(issue)
+			issue.Token = "child"
+			_ = json.NewEncoder(w).Encode(issue)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		parent := makeTokenWithKID(&types.MidgardClaims{Realm: "certificate"}, "", key(signerKey))
+
+		Convey("When I downscope it without validity", func() {
+
+			_, _, err := cl.Downscope(context.Background(), parent)
+
+			Convey("Then I should get a validation error", func() {
+				var verr *IssueValidationError
+				So(errors.As(err, &verr), ShouldBeTrue)
+				So(verr.Problems, ShouldResemble, []IssueValidationProblem{
+					{Field: "validity", Reason: "must be set as the parent token does not expire"},
+				})
+				So(issue, ShouldBeNil)
+			})
+		})
+
+		Convey("When I downscope it with a validity", func() {
+
+			token, _, err := cl.Downscope(context.Background(), parent, OptValidity(time.Minute))
+
+			Convey("Then the child token should be issued with the validity", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "child")
+				So(issue.Validity, ShouldEqual, "1m0s")
+			})
+		})
+	})
+
+	Convey("Given I have a client and an invalid parent token", t, func() {
+
+		cl := NewClient("https://midgard")
+
+		Convey("When I downscope it", func() {
+
+			_, _, err := cl.Downscope(context.Background(), "not-a-token", OptValidity(time.Minute))
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "unable to parse parent token")
+			})
+		})
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	endpointEjectionDuration    = 5 * time.Second
+	endpointMaxEjectionDuration = 1 * time.Minute
+)
+
+// EndpointHealth represents the health of one of
+// the midgard endpoints used by a Client.
+type EndpointHealth struct {
+	URL          string
+	Healthy      bool
+	Failures     int
+	EjectedUntil time.Time
+}
+
+type endpoint struct {
+	url          string
+	failures     int
+	ejectedUntil time.Time
+}
+
+// An endpointPool keeps track of the health of a list
+// of endpoints. Endpoints are preferred in the order they
+// are given. An endpoint is ejected as soon as it fails,
+// for a duration that doubles every consecutive failure.
+// Once its ejection expires, it is eligible again and the
+// next request or probe decides if it comes back.
+type endpointPool struct {
+	endpoints []*endpoint
+	lock      sync.Mutex
+}
+
+func newEndpointPool(urls []string) *endpointPool {
+
+	p := &endpointPool{
+		endpoints: make([]*endpoint, len(urls)),
+	}
+
+	for i, u := range urls {
+		p.endpoints[i] = &endpoint{url: u}
+	}
+
+	return p
+}
+
+// pick returns the first healthy endpoint. If all endpoints
+// are ejected, it returns the one that will recover first.
+func (p *endpointPool) pick() *endpoint {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+
+	var candidate *endpoint
+	for _, e := range p.endpoints {
+
+		if !now.Before(e.ejectedUntil) {
+			return e
+		}
+
+		if candidate == nil || e.ejectedUntil.Before(candidate.ejectedUntil) {
+			candidate = e
+		}
+	}
+
+	return candidate
+}
+
+// available returns true if at least one endpoint is healthy.
+func (p *endpointPool) available() bool {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+
+	for _, e := range p.endpoints {
+		if !now.Before(e.ejectedUntil) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ejected returns the list of currently ejected endpoints.
+func (p *endpointPool) ejected() []*endpoint {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+
+	var out []*endpoint
+	for _, e := range p.endpoints {
+		if now.Before(e.ejectedUntil) {
+			out = append(out, e)
+		}
+	}
+
+	return out
+}
+
+// success marks the given endpoint as healthy.
+func (p *endpointPool) success(e *endpoint) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	e.failures = 0
+	e.ejectedUntil = time.Time{}
+}
+
+// failure records a failure of the given endpoint and ejects it.
+func (p *endpointPool) failure(e *endpoint) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	d := endpointEjectionDuration << uint(e.failures)
+	if d <= 0 || d > endpointMaxEjectionDuration {
+		d = endpointMaxEjectionDuration
+	}
+
+	e.failures++
+	e.ejectedUntil = time.Now().Add(d)
+}
+
+// health returns the health of all endpoints.
+func (p *endpointPool) health() []EndpointHealth {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+
+	out := make([]EndpointHealth, len(p.endpoints))
+	for i, e := range p.endpoints {
+		out[i] = EndpointHealth{
+			URL:          e.url,
+			Healthy:      !now.Before(e.ejectedUntil),
+			Failures:     e.failures,
+			EjectedUntil: e.ejectedUntil,
+		}
+	}
+
+	return out
+}
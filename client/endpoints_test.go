@@ -0,0 +1,218 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia"
+)
+
+func TestEndpointPool(t *testing.T) {
+
+	Convey("Given I have an endpoint pool", t, func() {
+
+		p := newEndpointPool([]string{"a", "b"})
+
+		Convey("Then pick should return the first endpoint", func() {
+			So(p.pick().url, ShouldEqual, "a")
+			So(p.available(), ShouldBeTrue)
+		})
+
+		Convey("When the first endpoint fails", func() {
+
+			p.failure(p.endpoints[0])
+
+			Convey("Then pick should return the second endpoint", func() {
+				So(p.pick().url, ShouldEqual, "b")
+			})
+
+			Convey("Then the first endpoint should be ejected", func() {
+				So(len(p.ejected()), ShouldEqual, 1)
+				So(p.health()[0].Healthy, ShouldBeFalse)
+				So(p.health()[0].Failures, ShouldEqual, 1)
+				So(p.health()[1].Healthy, ShouldBeTrue)
+			})
+
+			Convey("When the second endpoint fails too", func() {
+
+				p.failure(p.endpoints[1])
+				p.failure(p.endpoints[1])
+
+				Convey("Then no endpoint should be available", func() {
+					So(p.available(), ShouldBeFalse)
+				})
+
+				Convey("Then pick should return the endpoint that recovers first", func() {
+					So(p.pick().url, ShouldEqual, "a")
+				})
+			})
+
+			Convey("When the first endpoint succeeds", func() {
+
+				p.success(p.endpoints[0])
+
+				Convey("Then pick should return the first endpoint", func() {
+					So(p.pick().url, ShouldEqual, "a")
+					So(p.health()[0].Failures, ShouldEqual, 0)
+				})
+			})
+		})
+
+		Convey("When an endpoint fails many times", func() {
+
+			for i := 0; i < 100; i++ {
+				p.failure(p.endpoints[0])
+			}
+
+			Convey("Then the ejection should be capped", func() {
+				So(p.endpoints[0].ejectedUntil, ShouldHappenBefore, time.Now().Add(endpointMaxEjectionDuration+time.Second))
+			})
+		})
+	})
+}
+
+func TestClient_Failover(t *testing.T) {
+
+	policy := RetryPolicy{
+		MaxAttempts:          3,
+		InitialBackoff:       time.Second,
+		Multiplier:           1,
+		RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+		RetryableErrors:      ErrorClassAll,
+	}
+
+	Convey("Given I have a client with an unavailable endpoint and a working one", t, func() {
+
+		var called1, called2 int32
+
+		ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called1, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ts1.Close()
+
+		ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called2, 1)
+			fmt.Fprintln(w, `{"token": "yeay!"}`)
+		}))
+		defer ts2.Close()
+
+		cl := NewClientWithEndpoints([]string{ts1.URL, ts2.URL}, &tls.Config{}, policy)
+
+		Convey("When I call sendRequest twice", func() {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			jwt1, err1 := cl.sendRequest(ctx, &gaia.Issue{Realm: "test"})
+			jwt2, err2 := cl.sendRequest(ctx, &gaia.Issue{Realm: "test"})
+
+			Convey("Then err should be nil", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+			})
+
+			Convey("Then jwt be correct", func() {
+				So(jwt1, ShouldEqual, "yeay!")
+				So(jwt2, ShouldEqual, "yeay!")
+			})
+
+			Convey("Then the unavailable endpoint should have been called only once", func() {
+				So(atomic.LoadInt32(&called1), ShouldEqual, 1)
+				So(atomic.LoadInt32(&called2), ShouldEqual, 2)
+			})
+
+			Convey("Then the endpoints health should be correct", func() {
+				h := cl.EndpointsHealth()
+				So(h[0].Healthy, ShouldBeFalse)
+				So(h[1].Healthy, ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("Given I have a client with an ejected endpoint that recovered", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer ts.Close()
+
+		cl := NewClientWithEndpoints([]string{ts.URL, "http://127.0.0.1:1"}, &tls.Config{}, policy)
+		cl.endpoints.failure(cl.endpoints.endpoints[0])
+
+		Convey("When I probe the endpoints", func() {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			go cl.ProbeEndpoints(ctx, time.Millisecond)
+
+			for len(cl.endpoints.ejected()) != 0 {
+				select {
+				case <-ctx.Done():
+					panic("timeout exceeded")
+				case <-time.After(time.Millisecond):
+				}
+			}
+
+			Convey("Then the endpoint should be healthy again", func() {
+				So(cl.EndpointsHealth()[0].Healthy, ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("Given I have a client with a slow endpoint", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer ts.Close()
+
+		cl := NewClientWithEndpoints([]string{ts.URL}, &tls.Config{}, policy)
+
+		Convey("When I cancel a request in flight", func() {
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			_, err := cl.sendRequest(ctx, &gaia.Issue{Realm: "test"})
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then the endpoint should still be healthy", func() {
+				h := cl.EndpointsHealth()
+				So(h[0].Healthy, ShouldBeTrue)
+				So(h[0].Failures, ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("Given I create a client with an empty endpoint list", t, func() {
+
+		Convey("Then it should panic", func() {
+			So(func() { NewClientWithEndpoints(nil, &tls.Config{}, policy) }, ShouldPanic)
+			So(func() { NewClientWithEndpoints([]string{"http://a", ""}, &tls.Config{}, policy) }, ShouldPanic)
+		})
+	})
+}
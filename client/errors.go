@@ -0,0 +1,231 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"go.aporeto.io/elemental"
+)
+
+// A RequestError is returned when midgard responded
+// to an issue or authn request with an error.
+type RequestError struct {
+
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Realm is the realm of the issue request.
+	// It is empty for authn requests.
+	Realm string
+
+	// Endpoint is the midgard endpoint that responded.
+	Endpoint string
+
+	// Errors contains the errors returned by midgard.
+	Errors elemental.Errors
+
+	// Err is the reason why the errors returned
+	// by midgard could not be decoded, if any.
+	Err error
+}
+
+func (e *RequestError) Error() string {
+
+	if len(e.Errors) > 0 {
+		return e.Errors.Error()
+	}
+
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("midgard responded with status code %d", e.StatusCode)
+}
+
+// Unwrap returns the errors returned by midgard
+// or the reason why they could not be decoded.
+func (e *RequestError) Unwrap() error {
+
+	if len(e.Errors) > 0 {
+		return e.Errors
+	}
+
+	return e.Err
+}
+
+// A TransportError is returned when the client
+// could not get a response from midgard.
+type TransportError struct {
+
+	// Realm is the realm of the issue request.
+	// It is empty for authn requests.
+	Realm string
+
+	// Endpoint is the midgard endpoint that was called.
+	Endpoint string
+
+	// Err is the underlying error, with any token
+	// or secret metadata it contained snipped.
+	Err error
+
+	class  ErrorClass
+	ctxErr error
+}
+
+func (e *TransportError) Error() string {
+
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *TransportError) Unwrap() error {
+
+	return e.Err
+}
+
+// Is returns true if the target is the error of the context given
+// by the caller and the request failed because it was done. The
+// underlying error may not wrap it anymore once its secrets are
+// snipped.
+func (e *TransportError) Is(target error) bool {
+
+	return e.ctxErr != nil && target == e.ctxErr
+}
+
+// IsUnauthorized returns true if the error indicates
+// that midgard rejected the provided credentials.
+func IsUnauthorized(err error) bool {
+
+	var rerr *RequestError
+	if !errors.As(err, &rerr) {
+		return false
+	}
+
+	return rerr.StatusCode == http.StatusUnauthorized || rerr.StatusCode == http.StatusForbidden
+}
+
+// IsTransient returns true if the error is likely to be
+// temporary and the request can be retried later. Requests
+// canceled by the caller or that exceeded the deadline of
+// the caller's context are not transient.
+func IsTransient(err error) bool {
+
+	var terr *TransportError
+	if errors.As(err, &terr) {
+		return terr.class != 0 && !isCanceledByCaller(terr)
+	}
+
+	var rerr *RequestError
+	if errors.As(err, &rerr) {
+		switch rerr.StatusCode {
+		case http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+	}
+
+	return false
+}
+
+// isCanceledByCaller returns true if the error is a TransportError
+// caused by the context given by the caller being done.
+func isCanceledByCaller(err error) bool {
+
+	var terr *TransportError
+	if !errors.As(err, &terr) {
+		return false
+	}
+
+	return terr.ctxErr != nil || errors.Is(terr, context.Canceled)
+}
+
+// IsTLSError returns true if the error is caused by a TLS
+// failure, like an untrusted or invalid server certificate.
+func IsTLSError(err error) bool {
+
+	var terr *TransportError
+	if !errors.As(err, &terr) {
+		return false
+	}
+
+	return terr.class == 0
+}
+
+// newTransportError returns a new TransportError from the given error.
+// The given secrets are removed from the error message.
+func newTransportError(err error, endpoint string, secrets ...string) *TransportError {
+
+	snipped := err
+	for _, secret := range secrets {
+		snipped = snipToken(snipped, secret)
+	}
+
+	return &TransportError{
+		Endpoint: endpoint,
+		Err:      snipped,
+		class:    classifyError(err),
+	}
+}
+
+// newRequestError returns a new RequestError from the given response.
+// It consumes and closes the response body.
+func newRequestError(resp *http.Response, endpoint string) *RequestError {
+
+	defer drainBody(resp.Body)
+
+	rerr := &RequestError{
+		StatusCode: resp.StatusCode,
+		Endpoint:   endpoint,
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		rerr.Err = fmt.Errorf("midgard responded with status code %d and client could not read why: %w", resp.StatusCode, err)
+		return rerr
+	}
+
+	if len(data) == 0 {
+		return rerr
+	}
+
+	errs, err := elemental.DecodeErrors(data)
+	if err != nil {
+		rerr.Err = fmt.Errorf("midgard responded with status code %d and client could not decode why: %w", resp.StatusCode, err)
+		return rerr
+	}
+
+	rerr.Errors = errs
+
+	return rerr
+}
+
+// withRealm sets the given realm to the given error
+// if it is a RequestError or a TransportError.
+func withRealm(err error, realm string) error {
+
+	switch e := err.(type) {
+	case *RequestError:
+		e.Realm = realm
+	case *TransportError:
+		e.Realm = realm
+	}
+
+	return err
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
+)
+
+func TestErrors_Authentify(t *testing.T) {
+
+	Convey("Given I have a client and a server that rejects the token", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		Convey("When I call Authentify", func() {
+
+			_, err := cl.Authentify(context.Background(), "thetoken")
+
+			Convey("Then err should be a RequestError", func() {
+				var rerr *RequestError
+				So(errors.As(err, &rerr), ShouldBeTrue)
+				So(rerr.StatusCode, ShouldEqual, http.StatusForbidden)
+				So(rerr.Endpoint, ShouldEqual, ts.URL)
+				So(rerr.Realm, ShouldBeEmpty)
+				So(err.Error(), ShouldEqual, "error 403 (midgard-lib): Forbidden: Authentication rejected with error: 403 Forbidden")
+			})
+
+			Convey("Then err should be unauthorized", func() {
+				So(IsUnauthorized(err), ShouldBeTrue)
+				So(IsTransient(err), ShouldBeFalse)
+				So(IsTLSError(err), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestErrors_sendRequest(t *testing.T) {
+
+	Convey("Given I have a client and a server that returns elemental errors", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, `[{"code": 401, "title": "Unauthorized", "description": "bad password", "subject": "midgard"}]`)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		Convey("When I call IssueFromVince", func() {
+
+			_, err := cl.IssueFromVince(context.Background(), "account", "password", "", time.Minute)
+
+			Convey("Then err should be a RequestError", func() {
+				var rerr *RequestError
+				So(errors.As(err, &rerr), ShouldBeTrue)
+				So(rerr.StatusCode, ShouldEqual, http.StatusUnauthorized)
+				So(rerr.Endpoint, ShouldEqual, ts.URL)
+				So(rerr.Realm, ShouldEqual, "Vince")
+				So(rerr.Errors, ShouldHaveLength, 1)
+				So(err.Error(), ShouldEqual, "error 401 (midgard): Unauthorized: bad password")
+			})
+
+			Convey("Then err should unwrap to elemental errors", func() {
+				var errs elemental.Errors
+				So(errors.As(err, &errs), ShouldBeTrue)
+				So(errs[0].Description, ShouldEqual, "bad password")
+			})
+
+			Convey("Then err should be unauthorized", func() {
+				So(IsUnauthorized(err), ShouldBeTrue)
+				So(IsTransient(err), ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given I have a client and a server that returns garbage errors", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, `not json`)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		Convey("When I call IssueFromCertificate", func() {
+
+			_, err := cl.IssueFromCertificate(context.Background(), time.Minute)
+
+			Convey("Then err should be a RequestError with a decoding error", func() {
+				var rerr *RequestError
+				So(errors.As(err, &rerr), ShouldBeTrue)
+				So(rerr.StatusCode, ShouldEqual, http.StatusBadRequest)
+				So(rerr.Errors, ShouldBeEmpty)
+				So(rerr.Err, ShouldNotBeNil)
+				So(IsUnauthorized(err), ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given I have a client and a server with an untrusted certificate", t, func() {
+
+		var called int32
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+		}))
+		defer ts.Close()
+
+		cl := NewClientWithTLS(ts.URL, &tls.Config{})
+
+		Convey("When I call IssueFromCertificate", func() {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err := cl.IssueFromCertificate(ctx, time.Minute)
+
+			Convey("Then err should be a TLS error", func() {
+				var terr *TransportError
+				So(errors.As(err, &terr), ShouldBeTrue)
+				So(terr.Endpoint, ShouldEqual, ts.URL)
+				So(terr.Realm, ShouldEqual, "Certificate")
+				So(IsTLSError(err), ShouldBeTrue)
+				So(IsTransient(err), ShouldBeFalse)
+			})
+
+			Convey("Then the request should not have been retried", func() {
+				So(ctx.Err(), ShouldBeNil)
+				So(atomic.LoadInt32(&called), ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("Given I have a client with a single attempt and an unreachable server", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		ts.Close()
+
+		p := DefaultRetryPolicy()
+		p.MaxAttempts = 1
+		cl := NewClientWithRetryPolicy(ts.URL, &tls.Config{}, p)
+
+		Convey("When I call Authentify", func() {
+
+			_, err := cl.Authentify(context.Background(), "thetoken")
+
+			Convey("Then err should be a transient TransportError", func() {
+				var terr *TransportError
+				So(errors.As(err, &terr), ShouldBeTrue)
+				So(IsTransient(err), ShouldBeTrue)
+				So(IsTLSError(err), ShouldBeFalse)
+				So(IsUnauthorized(err), ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given I have a client and a slow server", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		Convey("When I call Authentify with a context that is canceled", func() {
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			_, err := cl.Authentify(ctx, "thetoken")
+
+			Convey("Then err should not be transient", func() {
+				var terr *TransportError
+				So(errors.As(err, &terr), ShouldBeTrue)
+				So(errors.Is(err, context.Canceled), ShouldBeTrue)
+				So(IsTransient(err), ShouldBeFalse)
+				So(err.Error(), ShouldNotContainSubstring, "thetoken")
+			})
+		})
+
+		Convey("When I call Authentify with a context that expires", func() {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			_, err := cl.Authentify(ctx, "thetoken")
+
+			Convey("Then err should not be transient", func() {
+				var terr *TransportError
+				So(errors.As(err, &terr), ShouldBeTrue)
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+				So(IsTransient(err), ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given I have a client with a single attempt and an unavailable server", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ts.Close()
+
+		p := DefaultRetryPolicy()
+		p.MaxAttempts = 1
+		cl := NewClientWithRetryPolicy(ts.URL, &tls.Config{}, p)
+
+		Convey("When I call IssueFromCertificate", func() {
+
+			_, err := cl.IssueFromCertificate(context.Background(), time.Minute)
+
+			Convey("Then err should be transient", func() {
+				So(IsTransient(err), ShouldBeTrue)
+				So(err.Error(), ShouldEqual, "midgard responded with status code 503")
+			})
+		})
+	})
+}
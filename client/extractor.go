@@ -0,0 +1,147 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNoToken is returned by a TokenExtractor
+// when the request does not contain a token.
+var ErrNoToken = errors.New("no token found in request")
+
+// A TokenExtractor extracts a token from an http.Request.
+// It returns an error wrapping ErrNoToken if the request
+// does not contain a token.
+type TokenExtractor func(*http.Request) (string, error)
+
+// AuthorizationHeaderExtractor returns a TokenExtractor that extracts the
+// token from the Authorization header. The Bearer scheme is case
+// insensitive and extra whitespace is ignored.
+func AuthorizationHeaderExtractor() TokenExtractor {
+
+	return func(r *http.Request) (string, error) {
+		return ParseAuthorization(r.Header.Get("Authorization"))
+	}
+}
+
+// HeaderExtractor returns a TokenExtractor that extracts
+// the token from the value of the given header.
+func HeaderExtractor(name string) TokenExtractor {
+
+	return func(r *http.Request) (string, error) {
+
+		token := strings.TrimSpace(r.Header.Get(name))
+		if token == "" {
+			return "", fmt.Errorf("missing header '%s': %w", name, ErrNoToken)
+		}
+
+		return token, nil
+	}
+}
+
+// CookieExtractor returns a TokenExtractor that extracts
+// the token from the value of the given cookie.
+func CookieExtractor(name string) TokenExtractor {
+
+	return func(r *http.Request) (string, error) {
+
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return "", fmt.Errorf("missing cookie '%s': %w", name, ErrNoToken)
+		}
+
+		return cookie.Value, nil
+	}
+}
+
+// QueryExtractor returns a TokenExtractor that extracts
+// the token from the given query parameter.
+func QueryExtractor(name string) TokenExtractor {
+
+	return func(r *http.Request) (string, error) {
+
+		token := r.URL.Query().Get(name)
+		if token == "" {
+			return "", fmt.Errorf("missing query parameter '%s': %w", name, ErrNoToken)
+		}
+
+		return token, nil
+	}
+}
+
+// WebSocketProtocolExtractor returns a TokenExtractor that extracts the
+// token from the Sec-WebSocket-Protocol header of a WebSocket handshake.
+// The token is the part after the given prefix of the first requested
+// subprotocol starting with it, so with the prefix "bearer.", the
+// subprotocol "bearer.<token>" carries the token.
+func WebSocketProtocolExtractor(prefix string) TokenExtractor {
+
+	return func(r *http.Request) (string, error) {
+
+		for _, value := range r.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+			for _, protocol := range strings.Split(value, ",") {
+				protocol = strings.TrimSpace(protocol)
+				if strings.HasPrefix(protocol, prefix) && len(protocol) > len(prefix) {
+					return strings.TrimPrefix(protocol, prefix), nil
+				}
+			}
+		}
+
+		return "", fmt.Errorf("missing websocket subprotocol '%s': %w", prefix, ErrNoToken)
+	}
+}
+
+// ChainTokenExtractors returns a TokenExtractor that tries the given
+// extractors in order and returns the first token found. It stops at the
+// first error that does not wrap ErrNoToken, so a malformed token is
+// reported instead of being skipped.
+func ChainTokenExtractors(extractors ...TokenExtractor) TokenExtractor {
+
+	return func(r *http.Request) (string, error) {
+
+		for _, extractor := range extractors {
+
+			token, err := extractor(r)
+			if err == nil {
+				return token, nil
+			}
+
+			if !errors.Is(err, ErrNoToken) {
+				return "", err
+			}
+		}
+
+		return "", ErrNoToken
+	}
+}
+
+// ParseAuthorization returns the token from the given value of an
+// Authorization header or metadata. The Bearer scheme is case
+// insensitive and extra whitespace is ignored.
+func ParseAuthorization(auth string) (string, error) {
+
+	if strings.TrimSpace(auth) == "" {
+		return "", fmt.Errorf("missing authorization header: %w", ErrNoToken)
+	}
+
+	parts := strings.Fields(auth)
+
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", fmt.Errorf("invalid authorization header")
+	}
+
+	return parts[1], nil
+}
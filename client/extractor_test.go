@@ -0,0 +1,174 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenExtractors(t *testing.T) {
+
+	Convey("Given I have various requests", t, func() {
+
+		tests := []struct {
+			name      string
+			extractor TokenExtractor
+			setup     func(*http.Request)
+			token     string
+			noToken   bool
+			invalid   bool
+		}{
+			{
+				name:      "authorization header",
+				extractor: AuthorizationHeaderExtractor(),
+				setup:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer thetoken") },
+				token:     "thetoken",
+			},
+			{
+				name:      "authorization header with lowercase scheme and extra whitespace",
+				extractor: AuthorizationHeaderExtractor(),
+				setup:     func(r *http.Request) { r.Header.Set("Authorization", "  bearer \t thetoken ") },
+				token:     "thetoken",
+			},
+			{
+				name:      "missing authorization header",
+				extractor: AuthorizationHeaderExtractor(),
+				setup:     func(r *http.Request) {},
+				noToken:   true,
+			},
+			{
+				name:      "authorization header with another scheme",
+				extractor: AuthorizationHeaderExtractor(),
+				setup:     func(r *http.Request) { r.Header.Set("Authorization", "Basic dXNlcjpwYXNz") },
+				invalid:   true,
+			},
+			{
+				name:      "custom header",
+				extractor: HeaderExtractor("X-Token"),
+				setup:     func(r *http.Request) { r.Header.Set("X-Token", " thetoken ") },
+				token:     "thetoken",
+			},
+			{
+				name:      "missing custom header",
+				extractor: HeaderExtractor("X-Token"),
+				setup:     func(r *http.Request) {},
+				noToken:   true,
+			},
+			{
+				name:      "cookie",
+				extractor: CookieExtractor("token"),
+				setup:     func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "token", Value: "thetoken"}) },
+				token:     "thetoken",
+			},
+			{
+				name:      "missing cookie",
+				extractor: CookieExtractor("token"),
+				setup:     func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "other", Value: "thetoken"}) },
+				noToken:   true,
+			},
+			{
+				name:      "query parameter",
+				extractor: QueryExtractor("token"),
+				setup:     func(r *http.Request) { r.URL.RawQuery = "token=thetoken" },
+				token:     "thetoken",
+			},
+			{
+				name:      "missing query parameter",
+				extractor: QueryExtractor("token"),
+				setup:     func(r *http.Request) {},
+				noToken:   true,
+			},
+			{
+				name:      "websocket subprotocol",
+				extractor: WebSocketProtocolExtractor("bearer."),
+				setup:     func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "chat, bearer.thetoken") },
+				token:     "thetoken",
+			},
+			{
+				name:      "missing websocket subprotocol",
+				extractor: WebSocketProtocolExtractor("bearer."),
+				setup:     func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "chat, bearer.") },
+				noToken:   true,
+			},
+			{
+				name: "chain falling back to the cookie",
+				extractor: ChainTokenExtractors(
+					AuthorizationHeaderExtractor(),
+					CookieExtractor("token"),
+				),
+				setup: func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "token", Value: "thetoken"}) },
+				token: "thetoken",
+			},
+			{
+				name: "chain using the first token found",
+				extractor: ChainTokenExtractors(
+					QueryExtractor("token"),
+					AuthorizationHeaderExtractor(),
+				),
+				setup: func(r *http.Request) {
+					r.URL.RawQuery = "token=first"
+					r.Header.Set("Authorization", "Bearer second")
+				},
+				token: "first",
+			},
+			{
+				name: "chain stopping on an invalid token",
+				extractor: ChainTokenExtractors(
+					AuthorizationHeaderExtractor(),
+					CookieExtractor("token"),
+				),
+				setup: func(r *http.Request) {
+					r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+					r.AddCookie(&http.Cookie{Name: "token", Value: "thetoken"})
+				},
+				invalid: true,
+			},
+			{
+				name:      "chain without token",
+				extractor: ChainTokenExtractors(AuthorizationHeaderExtractor(), CookieExtractor("token")),
+				setup:     func(r *http.Request) {},
+				noToken:   true,
+			},
+		}
+
+		for _, tt := range tests {
+
+			Convey("When I extract the token from a request with "+tt.name, func() {
+
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				tt.setup(r)
+
+				token, err := tt.extractor(r)
+
+				Convey("Then the result should be correct", func() {
+					switch {
+					case tt.noToken:
+						So(errors.Is(err, ErrNoToken), ShouldBeTrue)
+						So(token, ShouldBeEmpty)
+					case tt.invalid:
+						So(err, ShouldNotBeNil)
+						So(errors.Is(err, ErrNoToken), ShouldBeFalse)
+						So(token, ShouldBeEmpty)
+					default:
+						So(err, ShouldBeNil)
+						So(token, ShouldEqual, tt.token)
+					}
+				})
+			})
+		}
+	})
+}
@@ -0,0 +1,359 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type loginOpts struct {
+	listenAddress  string
+	callbackPath   string
+	timeout        time.Duration
+	authURLHandler func(string) error
+	issueOptions   []Option
+}
+
+func newLoginOpts() loginOpts {
+
+	return loginOpts{
+		listenAddress:  "127.0.0.1:0",
+		callbackPath:   "/callback",
+		timeout:        5 * time.Minute,
+		authURLHandler: printAndOpenBrowser,
+	}
+}
+
+// A LoginOption is the type of various options you can pass
+// to IssueFromOIDCLogin and IssueFromSAMLLogin.
+type LoginOption func(*loginOpts)
+
+// OptLoginListenAddress sets the address the loopback server
+// listens on. The default is 127.0.0.1:0, which uses an
+// ephemeral port.
+func OptLoginListenAddress(address string) LoginOption {
+
+	return func(opts *loginOpts) {
+		opts.listenAddress = address
+	}
+}
+
+// OptLoginCallbackPath sets the path of the loopback server the
+// provider sends the user back to. The default is /callback.
+func OptLoginCallbackPath(path string) LoginOption {
+
+	return func(opts *loginOpts) {
+		opts.callbackPath = path
+	}
+}
+
+// OptLoginTimeout sets how long to wait for the user to log in.
+// The default is 5m. 0 means no timeout.
+func OptLoginTimeout(timeout time.Duration) LoginOption {
+
+	return func(opts *loginOpts) {
+		opts.timeout = timeout
+	}
+}
+
+// OptLoginAuthURLHandler sets the function called with the URL the user
+// must open to log in. By default, the URL is printed on the standard
+// error and opened in the default browser, if possible.
+func OptLoginAuthURLHandler(handler func(authURL string) error) LoginOption {
+
+	return func(opts *loginOpts) {
+		opts.authURLHandler = handler
+	}
+}
+
+// OptLoginIssueOptions sets the Options of the issue request
+// sent once the user is logged in.
+func OptLoginIssueOptions(options ...Option) LoginOption {
+
+	return func(opts *loginOpts) {
+		opts.issueOptions = options
+	}
+}
+
+// IssueFromOIDCLogin issues a Midgard jwt from an OIDC provider interactively.
+// It starts a loopback HTTP server, performs IssueFromOIDCStep1 with the server
+// as redirect URL and hands the returned auth URL to the user. Once the provider
+// redirects the user to the loopback server, it validates the received code
+// and state and performs IssueFromOIDCStep2 for the given validity.
+//
+// The auth URL must contain a state. Requests sent to the loopback server
+// with another state are rejected and do not end the login.
+//
+// It returns when the token is issued, the login times out or the given
+// context is done.
+func (a *Client) IssueFromOIDCLogin(ctx context.Context, namespace string, provider string, validity time.Duration, options ...LoginOption) (string, error) {
+
+	opts := newLoginOpts()
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	step1 := func(ctx context.Context, redirectURL string) (string, error) {
+
+		authURL, err := a.IssueFromOIDCStep1(ctx, namespace, provider, redirectURL)
+		if err != nil {
+			return "", err
+		}
+
+		if u, err := url.Parse(authURL); err != nil || u.Query().Get("state") == "" {
+			return "", fmt.Errorf("oidc auth url does not contain a state")
+		}
+
+		return authURL, nil
+	}
+
+	validate := func(r *http.Request, authURL *url.URL) error {
+
+		if r.URL.Query().Get("state") != authURL.Query().Get("state") {
+			return fmt.Errorf("oidc provider returned an invalid state")
+		}
+
+		return nil
+	}
+
+	step2 := func(ctx context.Context, r *http.Request) (string, error) {
+
+		query := r.URL.Query()
+
+		if e := query.Get("error"); e != "" {
+			return "", fmt.Errorf("oidc provider returned an error: %s: %s", e, query.Get("error_description"))
+		}
+
+		code := query.Get("code")
+		if code == "" {
+			return "", fmt.Errorf("oidc provider did not return a code")
+		}
+
+		return a.IssueFromOIDCStep2(ctx, code, query.Get("state"), validity, opts.issueOptions...)
+	}
+
+	return loopbackLogin(ctx, opts, step1, validate, step2)
+}
+
+// IssueFromSAMLLogin issues a Midgard jwt from a SAML provider interactively.
+// It starts a local assertion consumer service, performs IssueFromSAMLStep1
+// with it as redirect URL and hands the returned auth URL to the user. Once
+// the provider posts the SAMLResponse and RelayState to the local service, it
+// performs IssueFromSAMLStep2 for the given validity and shows the user
+// whether the login succeeded.
+//
+// The auth URL must contain a RelayState. Responses posted to the local
+// service with another RelayState are rejected and do not end the login.
+//
+// It returns when the token is issued, the login times out or the given
+// context is done.
+func (a *Client) IssueFromSAMLLogin(ctx context.Context, namespace string, provider string, validity time.Duration, options ...LoginOption) (string, error) {
+
+	opts := newLoginOpts()
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	step1 := func(ctx context.Context, redirectURL string) (string, error) {
+
+		authURL, err := a.IssueFromSAMLStep1(ctx, namespace, provider, redirectURL)
+		if err != nil {
+			return "", err
+		}
+
+		if u, err := url.Parse(authURL); err != nil || u.Query().Get("RelayState") == "" {
+			return "", fmt.Errorf("saml auth url does not contain a relay state")
+		}
+
+		return authURL, nil
+	}
+
+	validate := func(r *http.Request, authURL *url.URL) error {
+
+		if r.Method != http.MethodPost {
+			return fmt.Errorf("saml provider must post the response, got %s", r.Method)
+		}
+
+		if err := r.ParseForm(); err != nil {
+			return fmt.Errorf("unable to parse saml response: %w", err)
+		}
+
+		if r.PostForm.Get("RelayState") != authURL.Query().Get("RelayState") {
+			return fmt.Errorf("saml provider returned an invalid relay state")
+		}
+
+		return nil
+	}
+
+	step2 := func(ctx context.Context, r *http.Request) (string, error) {
+
+		response := r.PostForm.Get("SAMLResponse")
+		if response == "" {
+			return "", fmt.Errorf("saml provider did not return a response")
+		}
+
+		return a.IssueFromSAMLStep2(ctx, response, r.PostForm.Get("RelayState"), validity, opts.issueOptions...)
+	}
+
+	return loopbackLogin(ctx, opts, step1, validate, step2)
+}
+
+// loopbackLogin starts a loopback server, calls step1 with its URL and
+// hands the returned auth URL to the user. When the provider sends the
+// user back to the loopback server, it calls validate to check the request
+// belongs to this login, then step2 to issue the token and shows the user
+// the result. Requests received before the auth URL is known or that are
+// not valid are rejected without ending the login. Requests received
+// after step2 is called are rejected.
+func loopbackLogin(
+	ctx context.Context,
+	opts loginOpts,
+	step1 func(context.Context, string) (string, error),
+	validate func(*http.Request, *url.URL) error,
+	step2 func(context.Context, *http.Request) (string, error),
+) (string, error) {
+
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
+	listener, err := net.Listen("tcp", opts.listenAddress)
+	if err != nil {
+		return "", fmt.Errorf("unable to start loopback server: %w", err)
+	}
+
+	type result struct {
+		token string
+		err   error
+	}
+
+	var (
+		authURL  *url.URL
+		started  bool
+		lock     sync.Mutex
+		resultCh = make(chan result, 1)
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(opts.callbackPath, func(w http.ResponseWriter, r *http.Request) {
+
+		lock.Lock()
+		u := authURL
+		lock.Unlock()
+
+		if u == nil {
+			http.Error(w, "Login not started", http.StatusServiceUnavailable)
+			return
+		}
+
+		if err := validate(r, u); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid login response: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		lock.Lock()
+		alreadyStarted := started
+		started = true
+		lock.Unlock()
+
+		if alreadyStarted {
+			http.Error(w, "Login already completed", http.StatusConflict)
+			return
+		}
+
+		token, err := step2(ctx, r)
+
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "Login failed: %s\n", err)
+		} else {
+			fmt.Fprintln(w, "You are now logged in. You can close this window.")
+		}
+
+		resultCh <- result{token: token, err: err}
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener) // nolint: errcheck
+
+	// Let the callback answer the user before stopping.
+	defer func() {
+		sctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(sctx) // nolint: errcheck
+	}()
+
+	rawAuthURL, err := step1(ctx, fmt.Sprintf("http://%s%s", listener.Addr().String(), opts.callbackPath))
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(rawAuthURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid auth url: %w", err)
+	}
+
+	lock.Lock()
+	authURL = u
+	lock.Unlock()
+
+	if err := opts.authURLHandler(rawAuthURL); err != nil {
+		return "", fmt.Errorf("unable to handle auth url: %w", err)
+	}
+
+	select {
+	case r := <-resultCh:
+		return r.token, r.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("login not completed: %w", ctx.Err())
+	}
+}
+
+// OpenBrowser opens the given URL in the default browser.
+func OpenBrowser(u string) error {
+
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+
+	return cmd.Start()
+}
+
+// printAndOpenBrowser prints the given URL on the standard
+// error and tries to open it in the default browser.
+func printAndOpenBrowser(authURL string) error {
+
+	fmt.Fprintf(os.Stderr, "Open the following URL in your browser to log in:\n\n    %s\n\n", authURL)
+
+	_ = OpenBrowser(authURL)
+
+	return nil
+}
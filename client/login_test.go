@@ -0,0 +1,364 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia"
+)
+
+func TestClient_IssueFromOIDCLogin(t *testing.T) {
+
+	Convey("Given I have a midgard server supporting OIDC", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			issue := gaia.NewIssue()
+			_ = json.NewDecoder(r.Body).Decode(issue)
+
+			if redirectURL, ok := issue.Metadata["redirectURL"].(string); ok {
+				w.Header().Set("Location", "https://idp.com/auth?state=thestate&redirect_uri="+url.QueryEscape(redirectURL))
+				w.WriteHeader(http.StatusFound)
+				return
+			}
+
+			if issue.Metadata["code"] != "thecode" || issue.Metadata["state"] != "thestate" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			fmt.Fprintf(w, `{"token": "yeay!", "validity": "%s"}`, issue.Validity)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		// browser simulates the user logging in with the
+		// given query parameters sent back by the provider.
+		browser := func(query url.Values, response chan string) func(string) error {
+			return func(authURL string) error {
+				u, err := url.Parse(authURL)
+				if err != nil {
+					return err
+				}
+				go func() {
+					resp, err := http.Get(u.Query().Get("redirect_uri") + "?" + query.Encode())
+					if err != nil {
+						response <- err.Error()
+						return
+					}
+					defer resp.Body.Close() // nolint: errcheck
+					data, _ := ioutil.ReadAll(resp.Body)
+					response <- string(data)
+				}()
+				return nil
+			}
+		}
+
+		Convey("When the user logs in successfully", func() {
+
+			response := make(chan string, 1)
+			token, err := cl.IssueFromOIDCLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginAuthURLHandler(browser(url.Values{"code": {"thecode"}, "state": {"thestate"}}, response)),
+			)
+
+			Convey("Then the token should be issued", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "yeay!")
+				So(<-response, ShouldContainSubstring, "You are now logged in")
+			})
+		})
+
+		Convey("When a request with an invalid state is sent before the provider", func() {
+
+			invalid := make(chan string, 1)
+			response := make(chan string, 1)
+			token, err := cl.IssueFromOIDCLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginAuthURLHandler(func(authURL string) error {
+					go func() {
+						first := make(chan string, 1)
+						_ = browser(url.Values{"code": {"thecode"}, "state": {"other"}}, first)(authURL)
+						invalid <- <-first
+						_ = browser(url.Values{"code": {"thecode"}, "state": {"thestate"}}, response)(authURL)
+					}()
+					return nil
+				}),
+			)
+
+			Convey("Then the invalid request should be rejected", func() {
+				So(<-invalid, ShouldContainSubstring, "Invalid login response: oidc provider returned an invalid state")
+			})
+
+			Convey("Then the token should be issued", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "yeay!")
+				So(<-response, ShouldContainSubstring, "You are now logged in")
+			})
+		})
+
+		Convey("When the provider returns an error", func() {
+
+			response := make(chan string, 1)
+			_, err := cl.IssueFromOIDCLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginAuthURLHandler(browser(url.Values{"error": {"access_denied"}, "error_description": {"nope"}, "state": {"thestate"}}, response)),
+			)
+
+			Convey("Then err should be returned", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "oidc provider returned an error: access_denied: nope")
+				So(<-response, ShouldContainSubstring, "Login failed")
+			})
+		})
+
+		Convey("When the user never logs in", func() {
+
+			_, err := cl.IssueFromOIDCLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginTimeout(100*time.Millisecond),
+				OptLoginAuthURLHandler(func(string) error { return nil }),
+			)
+
+			Convey("Then err should be a timeout", func() {
+				So(err, ShouldNotBeNil)
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the auth url cannot be handled", func() {
+
+			_, err := cl.IssueFromOIDCLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginAuthURLHandler(func(string) error { return fmt.Errorf("boom") }),
+			)
+
+			Convey("Then err should be returned", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "unable to handle auth url: boom")
+			})
+		})
+	})
+}
+
+func TestClient_IssueFromOIDCLoginWithoutState(t *testing.T) {
+
+	Convey("Given I have a midgard server returning an auth url without state", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Location", "https://idp.com/auth")
+			w.WriteHeader(http.StatusFound)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		Convey("When I log in", func() {
+
+			var handled bool
+			_, err := cl.IssueFromOIDCLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginAuthURLHandler(func(string) error { handled = true; return nil }),
+			)
+
+			Convey("Then err should be returned", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "oidc auth url does not contain a state")
+				So(handled, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestClient_IssueFromSAMLLogin(t *testing.T) {
+
+	Convey("Given I have a midgard server supporting SAML", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			issue := gaia.NewIssue()
+			_ = json.NewDecoder(r.Body).Decode(issue)
+
+			if redirectURL, ok := issue.Metadata["redirectURL"].(string); ok {
+				w.Header().Set("Location", "https://idp.com/sso?RelayState=therelay&acs="+url.QueryEscape(redirectURL))
+				w.WriteHeader(http.StatusFound)
+				return
+			}
+
+			if issue.Metadata["SAMLResponse"] != "theresponse" || issue.Metadata["relayState"] != "therelay" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintln(w, `[{"code":401,"title":"Unauthorized","description":"invalid assertion","subject":"midgard"}]`)
+				return
+			}
+
+			fmt.Fprintln(w, `{"token": "yeay!"}`)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		// browser simulates the provider posting
+		// the given form to the local service.
+		browser := func(form url.Values, response chan string) func(string) error {
+			return func(authURL string) error {
+				u, err := url.Parse(authURL)
+				if err != nil {
+					return err
+				}
+				go func() {
+					resp, err := http.PostForm(u.Query().Get("acs"), form)
+					if err != nil {
+						response <- err.Error()
+						return
+					}
+					defer resp.Body.Close() // nolint: errcheck
+					data, _ := ioutil.ReadAll(resp.Body)
+					response <- string(data)
+				}()
+				return nil
+			}
+		}
+
+		Convey("When the user logs in successfully", func() {
+
+			response := make(chan string, 1)
+			token, err := cl.IssueFromSAMLLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginAuthURLHandler(browser(url.Values{"SAMLResponse": {"theresponse"}, "RelayState": {"therelay"}}, response)),
+			)
+
+			Convey("Then the token should be issued", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "yeay!")
+				So(<-response, ShouldContainSubstring, "You are now logged in")
+			})
+		})
+
+		Convey("When midgard rejects the assertion", func() {
+
+			response := make(chan string, 1)
+			_, err := cl.IssueFromSAMLLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginAuthURLHandler(browser(url.Values{"SAMLResponse": {"forged"}, "RelayState": {"therelay"}}, response)),
+			)
+
+			Convey("Then err should be returned and shown to the user", func() {
+				So(IsUnauthorized(err), ShouldBeTrue)
+				So(<-response, ShouldContainSubstring, "Login failed")
+			})
+		})
+
+		Convey("When the provider returns an invalid relay state", func() {
+
+			response := make(chan string, 1)
+			_, err := cl.IssueFromSAMLLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginTimeout(time.Second),
+				OptLoginAuthURLHandler(browser(url.Values{"SAMLResponse": {"theresponse"}, "RelayState": {"other"}}, response)),
+			)
+
+			Convey("Then the response should be rejected without ending the login", func() {
+				So(<-response, ShouldContainSubstring, "Invalid login response: saml provider returned an invalid relay state")
+				So(err, ShouldNotBeNil)
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the provider does not post a response", func() {
+
+			response := make(chan string, 1)
+			_, err := cl.IssueFromSAMLLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginAuthURLHandler(browser(url.Values{"RelayState": {"therelay"}}, response)),
+			)
+
+			Convey("Then err should be returned", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "saml provider did not return a response")
+			})
+		})
+	})
+}
+
+func TestClient_IssueFromSAMLLoginWithoutRelayState(t *testing.T) {
+
+	Convey("Given I have a midgard server returning an auth url without relay state", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Location", "https://idp.com/sso")
+			w.WriteHeader(http.StatusFound)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		Convey("When I log in", func() {
+
+			var handled bool
+			_, err := cl.IssueFromSAMLLogin(
+				context.Background(),
+				"/ns",
+				"provider",
+				time.Hour,
+				OptLoginAuthURLHandler(func(string) error { handled = true; return nil }),
+			)
+
+			Convey("Then err should be returned", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "saml auth url does not contain a relay state")
+				So(handled, ShouldBeFalse)
+			})
+		})
+	})
+}
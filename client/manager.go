@@ -18,8 +18,6 @@ import (
 	"os"
 	"time"
 
-	opentracing "github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/log"
 	"go.uber.org/zap"
 )
 
@@ -63,21 +61,20 @@ func (m *TokenManager) Run(ctx context.Context, tokenCh chan string) {
 				break
 			}
 
-			span, subctx := opentracing.StartSpanFromContext(ctx, "midgardlib.tokenmanager.renew")
+			span, subctx := m.client.tracer().StartSpan(ctx, "midgardlib.tokenmanager.renew")
 
 			token, err := m.Issue(subctx)
 			if err != nil {
-				span.SetTag("error", true)
-				span.LogFields(log.Error(err))
+				span.SetError(err)
 				span.Finish()
-				zap.L().Error("Unable to renew Midgard token", zap.Error(err))
+				m.client.log().Error("Unable to renew Midgard token", zap.Error(err))
 				break
 			}
 
 			tokenCh <- token
 
 			nextRefresh = now.Add(m.validity / 2)
-			zap.L().Info("Midgard token renewed")
+			m.client.log().Info("Midgard token renewed")
 			span.Finish()
 
 		case <-ctx.Done():
@@ -0,0 +1,144 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A ClaimsMatcher is a compiled subject expression that can be
+// matched against normalized claims.
+//
+// A subject expression is a list of clauses, each clause being a list of
+// tags like "@auth:realm=certificate". The expression matches if all the
+// tags of at least one clause are present in the claims. A tag ending
+// with '*' matches any claim starting with the part before the '*', so
+// "@auth:organization=*" matches any organization and
+// "@auth:namespace=/acme/*" matches any child namespace of /acme.
+// Keys are case insensitive, as NormalizeAuth lowercases them, but
+// values are not.
+type ClaimsMatcher struct {
+	clauses [][]matcherTerm
+}
+
+type matcherTerm struct {
+	value  string
+	prefix bool
+}
+
+func (t matcherTerm) match(claim string) bool {
+
+	if t.prefix {
+		return strings.HasPrefix(claim, t.value)
+	}
+
+	return claim == t.value
+}
+
+// CompileClaimsMatcher compiles the given subject expression.
+// It returns an error if a clause is empty, as it would match
+// any claims, or if a tag is not a key=value pair.
+func CompileClaimsMatcher(expression [][]string) (*ClaimsMatcher, error) {
+
+	clauses := make([][]matcherTerm, len(expression))
+
+	for i, clause := range expression {
+
+		if len(clause) == 0 {
+			return nil, fmt.Errorf("invalid subject expression: clause %d is empty", i)
+		}
+
+		terms := make([]matcherTerm, len(clause))
+
+		for j, tag := range clause {
+
+			idx := strings.Index(tag, "=")
+			if idx <= 0 {
+				return nil, fmt.Errorf("invalid subject expression: tag '%s' must be in the form key=value", tag)
+			}
+
+			tag = strings.ToLower(tag[:idx]) + tag[idx:]
+
+			if strings.HasSuffix(tag, "*") {
+				terms[j] = matcherTerm{value: strings.TrimSuffix(tag, "*"), prefix: true}
+			} else {
+				terms[j] = matcherTerm{value: tag}
+			}
+		}
+
+		clauses[i] = terms
+	}
+
+	return &ClaimsMatcher{
+		clauses: clauses,
+	}, nil
+}
+
+// MustCompileClaimsMatcher is like CompileClaimsMatcher
+// but panics if the expression is invalid.
+func MustCompileClaimsMatcher(expression [][]string) *ClaimsMatcher {
+
+	m, err := CompileClaimsMatcher(expression)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return m
+}
+
+// Match returns true if the given claims match the expression.
+func (m *ClaimsMatcher) Match(claims []string) bool {
+
+	for _, clause := range m.clauses {
+		if matchClause(clause, claims) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchClaims compiles the given subject expression and returns
+// true if the given claims match it. Use CompileClaimsMatcher to
+// match the same expression repeatedly.
+func MatchClaims(expression [][]string, claims []string) (bool, error) {
+
+	m, err := CompileClaimsMatcher(expression)
+	if err != nil {
+		return false, err
+	}
+
+	return m.Match(claims), nil
+}
+
+// matchClause returns true if all the terms of
+// the given clause match one of the given claims.
+func matchClause(clause []matcherTerm, claims []string) bool {
+
+	for _, term := range clause {
+
+		var found bool
+		for _, claim := range claims {
+			if term.match(claim) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClaimsMatcher_Match(t *testing.T) {
+
+	claims := []string{
+		"@auth:namespace=/acme/prod",
+		"@auth:organization=acme",
+		"@auth:organizationalunit=x",
+		"@auth:realm=certificate",
+		"@auth:subject=john",
+	}
+
+	Convey("Given I have various subject expressions", t, func() {
+
+		tests := []struct {
+			name       string
+			expression [][]string
+			match      bool
+		}{
+			{"single matching clause", [][]string{{"@auth:realm=certificate", "@auth:organization=acme"}}, true},
+			{"single clause with a missing tag", [][]string{{"@auth:realm=certificate", "@auth:organization=other"}}, false},
+			{"second clause matching", [][]string{{"@auth:realm=vince"}, {"@auth:subject=john"}}, true},
+			{"no clause matching", [][]string{{"@auth:realm=vince"}, {"@auth:subject=jane"}}, false},
+			{"wildcard value", [][]string{{"@auth:organization=*"}}, true},
+			{"wildcard on a missing key", [][]string{{"@auth:email=*"}}, false},
+			{"matching prefix", [][]string{{"@auth:namespace=/acme/*"}}, true},
+			{"non matching prefix", [][]string{{"@auth:namespace=/other/*"}}, false},
+			{"value must match exactly without wildcard", [][]string{{"@auth:organization=acm"}}, false},
+			{"key in another case", [][]string{{"@auth:organizationalUnit=x"}}, true},
+			{"value in another case", [][]string{{"@auth:organizationalunit=X"}}, false},
+			{"empty expression", nil, false},
+		}
+
+		for _, tt := range tests {
+
+			Convey("When I match the expression: "+tt.name, func() {
+
+				m, err := CompileClaimsMatcher(tt.expression)
+				So(err, ShouldBeNil)
+
+				Convey("Then the compiled matcher should return the expected result", func() {
+					So(m.Match(claims), ShouldEqual, tt.match)
+				})
+
+				Convey("Then MatchClaims should return the expected result", func() {
+					ok, err := MatchClaims(tt.expression, claims)
+					So(err, ShouldBeNil)
+					So(ok, ShouldEqual, tt.match)
+				})
+			})
+		}
+	})
+
+	Convey("Given I have an expression with an empty clause", t, func() {
+
+		expression := [][]string{{"@auth:realm=vince"}, {}}
+
+		Convey("When I compile it", func() {
+
+			m, err := CompileClaimsMatcher(expression)
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "invalid subject expression: clause 1 is empty")
+				So(m, ShouldBeNil)
+			})
+		})
+
+		Convey("When I match it", func() {
+
+			ok, err := MatchClaims(expression, claims)
+
+			Convey("Then it should not match", func() {
+				So(err, ShouldNotBeNil)
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given I have an expression with an invalid tag", t, func() {
+
+		expression := [][]string{{"@auth:realm"}}
+
+		Convey("When I compile it", func() {
+
+			_, err := CompileClaimsMatcher(expression)
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "invalid subject expression: tag '@auth:realm' must be in the form key=value")
+			})
+		})
+
+		Convey("When I must compile it", func() {
+
+			Convey("Then it should panic", func() {
+				So(func() { MustCompileClaimsMatcher(expression) }, ShouldPanic)
+			})
+		})
+	})
+}
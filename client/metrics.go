@@ -0,0 +1,41 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"time"
+)
+
+// A MetricsRecorder records metrics about the requests sent by a Client.
+// The given errors can be inspected with IsUnauthorized, IsTransient or
+// errors.As to label the metrics.
+type MetricsRecorder interface {
+
+	// ObserveIssue is called when an issue request
+	// for the given realm completes.
+	ObserveIssue(realm string, duration time.Duration, err error)
+
+	// ObserveAuthn is called when an authn request completes.
+	// Requests answered by the AuthentifyCache are not observed.
+	ObserveAuthn(duration time.Duration, err error)
+
+	// ObserveRetry is called when a request to the given endpoint is
+	// retried, after a response with the given status code or after a
+	// transport error if the status code is 0.
+	ObserveRetry(endpoint string, statusCode int)
+}
+
+type noopMetricsRecorder struct{}
+
+func (noopMetricsRecorder) ObserveIssue(string, time.Duration, error) {}
+func (noopMetricsRecorder) ObserveAuthn(time.Duration, error)         {}
+func (noopMetricsRecorder) ObserveRetry(string, int)                  {}
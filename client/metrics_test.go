@@ -0,0 +1,141 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeMetricsRecorder struct {
+	issues  []string
+	authns  []error
+	retries []int
+	lock    sync.Mutex
+}
+
+func (r *fakeMetricsRecorder) ObserveIssue(realm string, duration time.Duration, err error) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.issues = append(r.issues, realm)
+}
+
+func (r *fakeMetricsRecorder) ObserveAuthn(duration time.Duration, err error) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.authns = append(r.authns, err)
+}
+
+func (r *fakeMetricsRecorder) ObserveRetry(endpoint string, statusCode int) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.retries = append(r.retries, statusCode)
+}
+
+func TestClient_Metrics(t *testing.T) {
+
+	Convey("Given I have a client with a metrics recorder and a server failing once", t, func() {
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&called, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.URL.Path == "/authn" {
+				fmt.Fprintln(w, `{"claims":{"sub":"john"}}`)
+				return
+			}
+			fmt.Fprintln(w, `{"token": "yeay!"}`)
+		}))
+		defer ts.Close()
+
+		p := DefaultRetryPolicy()
+		p.InitialBackoff = time.Millisecond
+
+		r := &fakeMetricsRecorder{}
+		cl := NewClientWithRetryPolicy(ts.URL, &tls.Config{}, p)
+		cl.Metrics = r
+
+		Convey("When I call IssueFromCertificate", func() {
+
+			token, err := cl.IssueFromCertificate(context.Background(), time.Minute)
+
+			Convey("Then the issue and the retry should be observed", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "yeay!")
+				So(r.issues, ShouldResemble, []string{"Certificate"})
+				So(r.retries, ShouldResemble, []int{http.StatusServiceUnavailable})
+				So(r.authns, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When I call Authentify", func() {
+
+			_, err := cl.Authentify(context.Background(), "thetoken")
+
+			Convey("Then the authn and the retry should be observed", func() {
+				So(err, ShouldBeNil)
+				So(r.authns, ShouldResemble, []error{nil})
+				So(r.retries, ShouldResemble, []int{http.StatusServiceUnavailable})
+				So(r.issues, ShouldBeEmpty)
+			})
+		})
+	})
+
+	Convey("Given I have a client with a metrics recorder and a server failing after the caller gave up", t, func() {
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			cancel()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ts.Close()
+
+		p := DefaultRetryPolicy()
+		p.InitialBackoff = time.Millisecond
+
+		r := &fakeMetricsRecorder{}
+		cl := NewClientWithRetryPolicy(ts.URL, &tls.Config{}, p)
+		cl.Metrics = r
+
+		Convey("When I call Authentify", func() {
+
+			_, err := cl.Authentify(ctx, "thetoken")
+
+			Convey("Then no retry should be done nor observed", func() {
+				So(err, ShouldNotBeNil)
+				So(atomic.LoadInt32(&called), ShouldEqual, 1)
+				So(r.retries, ShouldBeEmpty)
+			})
+		})
+	})
+}
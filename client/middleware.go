@@ -0,0 +1,296 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"go.aporeto.io/elemental"
+	"go.aporeto.io/gaia/types"
+	"go.uber.org/zap"
+)
+
+type middlewareOpts struct {
+	verifier       *Verifier
+	verifyOptions  []VerifyOption
+	tokenExtractor TokenExtractor
+	sourceIP       func(*http.Request) net.IP
+	tracer         Tracer
+}
+
+// A MiddlewareOption is the type of various options
+// you can pass to NewHTTPMiddleware and NewAuthenticatorFunc.
+type MiddlewareOption func(*middlewareOpts)
+
+// OptMiddlewareVerifier makes the middleware verify the tokens locally
+// with the given Verifier and VerifyOptions instead of sending them to
+// midgard.
+func OptMiddlewareVerifier(verifier *Verifier, options ...VerifyOption) MiddlewareOption {
+
+	return func(opts *middlewareOpts) {
+		opts.verifier = verifier
+		opts.verifyOptions = options
+	}
+}
+
+// OptMiddlewareTokenExtractor sets the TokenExtractor used by the
+// middleware to extract the token from the requests. By default, the
+// token is extracted from the Authorization header.
+func OptMiddlewareTokenExtractor(extractor TokenExtractor) MiddlewareOption {
+
+	return func(opts *middlewareOpts) {
+		opts.tokenExtractor = extractor
+	}
+}
+
+// OptMiddlewareEnforceNetworkRestrictions makes the middleware reject
+// the requests sent from an IP the token is not restricted to. The IP
+// is returned by the given function, or taken from the remote address
+// of the request if it is nil.
+func OptMiddlewareEnforceNetworkRestrictions(sourceIP func(*http.Request) net.IP) MiddlewareOption {
+
+	if sourceIP == nil {
+		sourceIP = remoteAddrIP
+	}
+
+	return func(opts *middlewareOpts) {
+		opts.sourceIP = sourceIP
+	}
+}
+
+// OptMiddlewareTracer sets the Tracer used by the middleware to trace
+// the requests. By default, the Tracer of the Client is used.
+func OptMiddlewareTracer(tracer Tracer) MiddlewareOption {
+
+	return func(opts *middlewareOpts) {
+		opts.tracer = tracer
+	}
+}
+
+// An AuthenticatorFunc authenticates the given token and
+// returns its normalized claims and its MidgardClaims.
+type AuthenticatorFunc func(ctx context.Context, token string) ([]string, *types.MidgardClaims, error)
+
+// NewAuthenticatorFunc returns an AuthenticatorFunc that authenticates
+// tokens using the given Client, or the Verifier given with
+// OptMiddlewareVerifier.
+func NewAuthenticatorFunc(client *Client, options ...MiddlewareOption) AuthenticatorFunc {
+
+	opts := middlewareOpts{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	if client == nil && opts.verifier == nil {
+		panic("client cannot be nil")
+	}
+
+	return func(ctx context.Context, token string) ([]string, *types.MidgardClaims, error) {
+
+		if opts.verifier != nil {
+			claims, err := opts.verifier.Verify(ctx, token, opts.verifyOptions...)
+			if err != nil {
+				return nil, nil, err
+			}
+			return NormalizeAuth(claims), claims, nil
+		}
+
+		claims, err := client.AuthentifyClaims(ctx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+		return claims.Tags(), claims.MidgardClaims(), nil
+	}
+}
+
+// NewHTTPMiddleware returns a middleware that authenticates the token
+// sent in the Authorization header of each request, or extracted by the
+// TokenExtractor given with OptMiddlewareTokenExtractor, using the given
+// Client, or the Verifier given with OptMiddlewareVerifier.
+//
+// The token and its claims are stored in the context of the request
+// passed to the next handler and can be retrieved with TokenFromContext,
+// ClaimsFromContext and MidgardClaimsFromContext. The incoming span, if
+// any, is continued.
+//
+// Requests with a missing or invalid token are rejected with 401.
+// Requests with a valid token that does not satisfy the VerifyOptions
+// or, when enforced, its network restrictions are rejected with 403.
+// If midgard cannot be reached, they are rejected with 503. The body
+// of the response is a list of elemental errors.
+func NewHTTPMiddleware(client *Client, options ...MiddlewareOption) func(http.Handler) http.Handler {
+
+	opts := middlewareOpts{
+		tokenExtractor: AuthorizationHeaderExtractor(),
+	}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	authenticate := NewAuthenticatorFunc(client, options...)
+
+	tracer := opts.tracer
+	if tracer == nil {
+		switch {
+		case client != nil:
+			tracer = client.tracer()
+		case opts.verifier != nil:
+			tracer = opts.verifier.client.tracer()
+		default:
+			tracer = defaultTracer
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			span, ctx := tracer.StartServerSpan(r.Context(), "midgardlib.middleware.authenticate", r.Header)
+			defer span.Finish()
+
+			// The query is not traced as it may contain the token.
+			u := *r.URL
+			u.RawQuery = ""
+
+			span.SetTag("http.method", r.Method)
+			span.SetTag("http.url", u.String())
+
+			token, err := opts.tokenExtractor(r)
+			if err != nil {
+				writeAuthError(w, span, http.StatusUnauthorized, err)
+				return
+			}
+
+			claims, midgardClaims, err := authenticate(ctx, token)
+			if err == nil && opts.sourceIP != nil {
+				err = checkNetworkRestrictions(midgardClaims, opts.sourceIP(r))
+			}
+			if err != nil {
+				writeAuthError(w, span, AuthErrorStatusCode(err), err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ContextWithAuth(ctx, token, claims, midgardClaims)))
+		})
+	}
+}
+
+// AuthErrorStatusCode returns the HTTP status code to use to reject
+// a request for the given error returned by an AuthenticatorFunc.
+// Only the errors concerning the token are rejected with 401 or 403.
+// Midgard failures are rejected with 503 and requests canceled by the
+// caller with 408.
+func AuthErrorStatusCode(err error) int {
+
+	var (
+		realmErr     *RealmError
+		audienceErr  *AudienceError
+		namespaceErr *RestrictedNamespaceError
+		networkErr   *RestrictedNetworkError
+		fetchErr     *CertificatesFetchError
+		requestErr   *RequestError
+		transportErr *TransportError
+	)
+
+	switch {
+	case errors.As(err, &realmErr), errors.As(err, &audienceErr), errors.As(err, &namespaceErr), errors.As(err, &networkErr):
+		return http.StatusForbidden
+	case isCanceledByCaller(err):
+		return http.StatusRequestTimeout
+	case errors.As(err, &fetchErr):
+		return http.StatusServiceUnavailable
+	case IsUnauthorized(err):
+		return http.StatusUnauthorized
+	case errors.As(err, &requestErr) && requestErr.StatusCode >= http.StatusInternalServerError:
+		return http.StatusServiceUnavailable
+	case errors.As(err, &transportErr), IsTransient(err):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusUnauthorized
+	}
+}
+
+// AuthErrorDescription returns the description sent to the caller when
+// a request is rejected with the given HTTP status code. It never contains
+// the details of the error, which are only logged.
+func AuthErrorDescription(code int) string {
+
+	switch code {
+	case http.StatusForbidden:
+		return "The token is not allowed to access this resource."
+	case http.StatusServiceUnavailable:
+		return "Unable to authenticate: the authentication service is unavailable."
+	case http.StatusRequestTimeout:
+		return "The request was canceled before the token could be verified."
+	default:
+		return "The token is missing or invalid."
+	}
+}
+
+// checkNetworkRestrictions returns a RestrictedNetworkError if the
+// given claims are restricted to networks not containing the given IP.
+func checkNetworkRestrictions(claims *types.MidgardClaims, ip net.IP) error {
+
+	r := RestrictionsFromMidgardClaims(claims)
+	if !r.AllowsSourceIP(ip) {
+		return &RestrictedNetworkError{IP: ip, Networks: r.Networks}
+	}
+
+	return nil
+}
+
+// remoteAddrIP returns the IP of the remote address of the given request.
+func remoteAddrIP(r *http.Request) net.IP {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// writeAuthError writes an elemental error for the given status code.
+// The given error is only logged, as it may contain internal details.
+func writeAuthError(w http.ResponseWriter, span Span, code int, err error) {
+
+	span.SetTag("http.status_code", code)
+	span.SetError(err)
+
+	if code == http.StatusServiceUnavailable {
+		zap.L().Error("Unable to authenticate request", zap.Error(err))
+	} else {
+		zap.L().Debug("Authentication rejected", zap.Int("code", code), zap.Error(err))
+	}
+
+	title := http.StatusText(code)
+	description := AuthErrorDescription(code)
+
+	data, merr := json.Marshal(elemental.NewErrors(elemental.NewError(title, description, "midgard-lib", code)))
+	if merr != nil {
+		zap.L().Error("Unable to encode authentication error", zap.Error(merr))
+	}
+
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+
+	if _, err := w.Write(data); err != nil {
+		zap.L().Debug("Unable to write authentication error", zap.Error(err))
+	}
+}
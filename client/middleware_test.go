@@ -0,0 +1,421 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
+	"go.aporeto.io/gaia"
+	"go.aporeto.io/gaia/types"
+)
+
+func TestContext_Accessors(t *testing.T) {
+
+	Convey("Given I have an empty context", t, func() {
+
+		ctx := context.Background()
+
+		Convey("Then the accessors should return nothing", func() {
+			_, ok1 := TokenFromContext(ctx)
+			_, ok2 := ClaimsFromContext(ctx)
+			_, ok3 := MidgardClaimsFromContext(ctx)
+			So(ok1, ShouldBeFalse)
+			So(ok2, ShouldBeFalse)
+			So(ok3, ShouldBeFalse)
+		})
+
+		Convey("When I store auth information without MidgardClaims", func() {
+
+			ctx = ContextWithAuth(ctx, "token", []string{"@auth:a=b"}, nil)
+
+			Convey("Then the accessors should return it", func() {
+				token, ok1 := TokenFromContext(ctx)
+				claims, ok2 := ClaimsFromContext(ctx)
+				_, ok3 := MidgardClaimsFromContext(ctx)
+				So(ok1, ShouldBeTrue)
+				So(token, ShouldEqual, "token")
+				So(ok2, ShouldBeTrue)
+				So(claims, ShouldResemble, []string{"@auth:a=b"})
+				So(ok3, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestAuthErrorStatusCode(t *testing.T) {
+
+	Convey("Given I have various authentication errors", t, func() {
+
+		tests := []struct {
+			name string
+			err  error
+			code int
+		}{
+			{"missing token", fmt.Errorf("missing authorization header: %w", ErrNoToken), http.StatusUnauthorized},
+			{"invalid signature", errors.New("crypto/ecdsa: verification error"), http.StatusUnauthorized},
+			{"token rejected by midgard", &RequestError{StatusCode: http.StatusUnauthorized}, http.StatusUnauthorized},
+			{"token forbidden by midgard", &RequestError{StatusCode: http.StatusForbidden}, http.StatusUnauthorized},
+			{"invalid realm", &RealmError{}, http.StatusForbidden},
+			{"restricted network", &RestrictedNetworkError{}, http.StatusForbidden},
+			{"midgard internal error", &RequestError{StatusCode: http.StatusInternalServerError}, http.StatusServiceUnavailable},
+			{"midgard not implemented", &RequestError{StatusCode: http.StatusNotImplemented}, http.StatusServiceUnavailable},
+			{"midgard unavailable", &RequestError{StatusCode: http.StatusServiceUnavailable}, http.StatusServiceUnavailable},
+			{"midgard unreachable", &TransportError{Err: errors.New("refused"), class: ErrorClassNetwork}, http.StatusServiceUnavailable},
+			{"certificates not fetched", &CertificatesFetchError{Err: &RequestError{StatusCode: http.StatusForbidden}}, http.StatusServiceUnavailable},
+			{"certificates not parsed", &CertificatesFetchError{Err: errors.New("no signing certificate returned")}, http.StatusServiceUnavailable},
+			{"canceled by the caller", &TransportError{Err: errors.New("canceled"), class: ErrorClassOther, ctxErr: context.Canceled}, http.StatusRequestTimeout},
+		}
+
+		for _, tt := range tests {
+			Convey("Then the status code should be correct for: "+tt.name, func() {
+				So(AuthErrorStatusCode(tt.err), ShouldEqual, tt.code)
+			})
+		}
+	})
+}
+
+func TestMiddleware_Remote(t *testing.T) {
+
+	Convey("Given I create a middleware without client", t, func() {
+		So(func() { NewHTTPMiddleware(nil) }, ShouldPanicWith, "client cannot be nil")
+	})
+
+	Convey("Given I have a middleware using a midgard server", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authn := gaia.NewAuthn()
+			_ = json.NewDecoder(r.Body).Decode(authn)
+			if authn.Token != "good" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintln(w, `[{"code":401,"title":"Unauthorized","description":"nope","subject":"midgard"}]`)
+				return
+			}
+			fmt.Fprintln(w, `{"claims":{"sub":"john","data":{"commonName":"john"}}}`)
+		}))
+		defer ts.Close()
+
+		var receivedCtx context.Context
+		h := NewHTTPMiddleware(NewClient(ts.URL))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedCtx = r.Context()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		Convey("When I send a request with a valid token", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer good")
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the request should be passed to the next handler", func() {
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+			})
+
+			Convey("Then the claims should be in the context", func() {
+				token, _ := TokenFromContext(receivedCtx)
+				claims, _ := ClaimsFromContext(receivedCtx)
+				So(token, ShouldEqual, "good")
+				So(claims, ShouldContain, "@auth:subject=john")
+				So(claims, ShouldContain, "@auth:commonname=john")
+			})
+
+			Convey("Then the MidgardClaims should be in the context", func() {
+				claims, ok := MidgardClaimsFromContext(receivedCtx)
+				So(ok, ShouldBeTrue)
+				So(claims.Subject, ShouldEqual, "john")
+			})
+		})
+
+		Convey("When I send a request with an invalid token", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer bad")
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the request should be rejected with 401", func() {
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+				So(w.Header().Get("WWW-Authenticate"), ShouldEqual, "Bearer")
+				So(receivedCtx, ShouldBeNil)
+			})
+
+			Convey("Then the body should contain elemental errors", func() {
+				errs, err := elemental.DecodeErrors(w.Body.Bytes())
+				So(err, ShouldBeNil)
+				So(len(errs), ShouldEqual, 1)
+				So(errs[0].Code, ShouldEqual, http.StatusUnauthorized)
+				So(errs[0].Subject, ShouldEqual, "midgard-lib")
+			})
+		})
+
+		Convey("When I send a request without token", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the request should be rejected with 401", func() {
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+				So(w.Body.String(), ShouldContainSubstring, AuthErrorDescription(http.StatusUnauthorized))
+			})
+		})
+	})
+
+	Convey("Given I have a middleware using a midgard server and a cookie extractor", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, `{"claims":{"sub":"john"}}`)
+		}))
+		defer ts.Close()
+
+		var receivedCtx context.Context
+		h := NewHTTPMiddleware(
+			NewClient(ts.URL),
+			OptMiddlewareTokenExtractor(CookieExtractor("token")),
+		)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedCtx = r.Context()
+		}))
+
+		Convey("When I send a request with the token in a cookie", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(&http.Cookie{Name: "token", Value: "good"})
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the token should be extracted from the cookie", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				token, _ := TokenFromContext(receivedCtx)
+				So(token, ShouldEqual, "good")
+			})
+		})
+	})
+
+	Convey("Given I have a middleware using a midgard server that is down", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		url := ts.URL
+		ts.Close()
+
+		policy := DefaultRetryPolicy()
+		policy.MaxAttempts = 1
+
+		h := NewHTTPMiddleware(NewClientWithRetryPolicy(url, nil, policy))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		Convey("When I send a request", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer good")
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the request should be rejected with 503", func() {
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+
+			Convey("Then the response should not contain the error details", func() {
+				So(w.Body.String(), ShouldContainSubstring, AuthErrorDescription(http.StatusServiceUnavailable))
+				So(w.Body.String(), ShouldNotContainSubstring, url)
+			})
+		})
+	})
+}
+
+func TestMiddleware_QueryToken(t *testing.T) {
+
+	Convey("Given I have a middleware extracting the token from the query", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, `{"claims":{"sub":"john"}}`)
+		}))
+		defer ts.Close()
+
+		tracer := mocktracer.New()
+		opentracing.SetGlobalTracer(tracer)
+		defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+		h := NewHTTPMiddleware(
+			NewClient(ts.URL),
+			OptMiddlewareTokenExtractor(QueryExtractor("token")),
+		)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		Convey("When I send a request with a token in the query", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/path?token=secret&a=b", nil)
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the token should not be traced", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				spans := tracer.FinishedSpans()
+				span := spans[len(spans)-1]
+				So(span.OperationName, ShouldEqual, "midgardlib.middleware.authenticate")
+				So(span.Tag("http.url"), ShouldEqual, "/path")
+			})
+		})
+	})
+}
+
+func TestMiddleware_Local(t *testing.T) {
+
+	Convey("Given I have a middleware using a local verifier", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(signerCert)
+		}))
+		defer ts.Close()
+
+		tracer := mocktracer.New()
+		opentracing.SetGlobalTracer(tracer)
+		defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+		v := NewVerifier(NewClient(ts.URL))
+
+		var receivedCtx context.Context
+		h := NewHTTPMiddleware(
+			nil,
+			OptMiddlewareVerifier(v, OptVerifyRealms("certificate")),
+		)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedCtx = r.Context()
+		}))
+
+		makeClaims := func(realm string) *types.MidgardClaims {
+			return &types.MidgardClaims{
+				Realm:          realm,
+				StandardClaims: jwt.StandardClaims{Subject: "john"},
+			}
+		}
+
+		Convey("When I send a request with a valid token and a parent span", func() {
+
+			parent := tracer.StartSpan("parent")
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+makeTokenWithKID(makeClaims("certificate"), "", key(signerKey)))
+			_ = tracer.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the request should be passed to the next handler", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+			})
+
+			Convey("Then the MidgardClaims should be in the context", func() {
+				claims, ok := MidgardClaimsFromContext(receivedCtx)
+				So(ok, ShouldBeTrue)
+				So(claims.Subject, ShouldEqual, "john")
+			})
+
+			Convey("Then the incoming span should be continued", func() {
+				span := opentracing.SpanFromContext(receivedCtx).(*mocktracer.MockSpan)
+				So(span.ParentID, ShouldEqual, parent.(*mocktracer.MockSpan).SpanContext.SpanID)
+				So(span.SpanContext.TraceID, ShouldEqual, parent.(*mocktracer.MockSpan).SpanContext.TraceID)
+			})
+		})
+
+		Convey("When I send a request with a token from the wrong realm", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+makeTokenWithKID(makeClaims("vince"), "", key(signerKey)))
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the request should be rejected with 403", func() {
+				So(w.Code, ShouldEqual, http.StatusForbidden)
+				So(receivedCtx, ShouldBeNil)
+			})
+		})
+
+		Convey("When I send a request with a token signed by the wrong key", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+makeTokenWithKID(makeClaims("certificate"), "", key(wrongSignerKey)))
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the request should be rejected with 401", func() {
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+	})
+}
+
+func TestMiddleware_NetworkRestrictions(t *testing.T) {
+
+	Convey("Given I have a middleware enforcing network restrictions", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(signerCert)
+		}))
+		defer ts.Close()
+
+		h := NewHTTPMiddleware(
+			nil,
+			OptMiddlewareVerifier(NewVerifier(NewClient(ts.URL))),
+			OptMiddlewareEnforceNetworkRestrictions(nil),
+		)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		token := makeTokenWithKID(&types.MidgardClaims{
+			Realm:          "certificate",
+			StandardClaims: jwt.StandardClaims{Subject: "john"},
+			Restrictions:   &types.MidgardClaimsRestrictions{Networks: []string{"10.0.0.0/8"}},
+		}, "", key(signerKey))
+
+		Convey("When I send a request from a restricted network", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.1.2.3:4242"
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the request should be passed to the next handler", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When I send a request from another network", func() {
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.168.1.1:4242"
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			Convey("Then the request should be rejected with 403", func() {
+				So(w.Code, ShouldEqual, http.StatusForbidden)
+			})
+		})
+	})
+}
@@ -11,6 +11,18 @@
 
 package midgardclient
 
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
 type issueOpts struct {
 	quota                 int
 	opaque                map[string]string
@@ -18,6 +30,7 @@ type issueOpts struct {
 	restrictedNamespace   string
 	restrictedPermissions []string
 	restrictedNetworks    []string
+	validity              time.Duration
 }
 
 // An Option is the type of various options
@@ -25,13 +38,9 @@ type issueOpts struct {
 type Option func(*issueOpts)
 
 // OptQuota sets the maximum time the issued token
-// can be used.
+// can be used. It must be a positive number.
 func OptQuota(quota int) Option {
 
-	if quota < 0 {
-		panic("quota must be a positive number")
-	}
-
 	return func(opts *issueOpts) {
 		opts.quota = quota
 	}
@@ -56,6 +65,7 @@ func OptAudience(audience string) Option {
 }
 
 // OptRestrictNamespace asks for a restricted token on the given namespace.
+// The namespace must be an absolute path like /a/b.
 func OptRestrictNamespace(namespace string) Option {
 
 	return func(opts *issueOpts) {
@@ -64,6 +74,8 @@ func OptRestrictNamespace(namespace string) Option {
 }
 
 // OptRestrictPermissions asks for a restricted token on the given permissions.
+// Each permission must either be a tag like @auth:role=viewer or an identity
+// followed by a list of operations like namespace,get,post.
 func OptRestrictPermissions(permissions []string) Option {
 
 	return func(opts *issueOpts) {
@@ -72,9 +84,322 @@ func OptRestrictPermissions(permissions []string) Option {
 }
 
 // OptRestrictNetworks asks for a restricted token on the given networks.
+// Each network must be a CIDR like 10.0.0.0/8.
 func OptRestrictNetworks(networks []string) Option {
 
 	return func(opts *issueOpts) {
 		opts.restrictedNetworks = networks
 	}
 }
+
+// OptValidity sets the validity of the token issued by Downscope.
+// The other issue methods take the validity as a parameter and
+// reject this option with an IssueValidationError.
+func OptValidity(validity time.Duration) Option {
+
+	return func(opts *issueOpts) {
+		opts.validity = validity
+	}
+}
+
+// permissionOperations contains the valid
+// operations of a restricted permission.
+var permissionOperations = map[string]struct{}{
+	"*":      {},
+	"get":    {},
+	"post":   {},
+	"put":    {},
+	"delete": {},
+	"patch":  {},
+	"head":   {},
+}
+
+// validateIssueOpts validates the given issueOpts
+// and returns the problems found.
+func validateIssueOpts(opts issueOpts) []IssueValidationProblem {
+
+	var problems []IssueValidationProblem
+
+	if opts.quota < 0 {
+		problems = append(problems, IssueValidationProblem{Field: "quota", Reason: "must be a positive number"})
+	}
+
+	if opts.validity != 0 {
+		problems = append(problems, IssueValidationProblem{Field: "validity", Reason: "OptValidity is only supported by Downscope"})
+	}
+
+	if opts.restrictedNamespace != "" {
+		if err := validateNamespace(opts.restrictedNamespace); err != nil {
+			problems = append(problems, IssueValidationProblem{Field: "restrictedNamespace", Reason: err.Error()})
+		}
+	}
+
+	for i, permission := range opts.restrictedPermissions {
+		if err := validatePermission(permission); err != nil {
+			problems = append(problems, IssueValidationProblem{Field: fmt.Sprintf("restrictedPermissions[%d]", i), Reason: err.Error()})
+		}
+	}
+
+	for i, network := range opts.restrictedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			problems = append(problems, IssueValidationProblem{Field: fmt.Sprintf("restrictedNetworks[%d]", i), Reason: fmt.Sprintf("'%s' is not a valid CIDR", network)})
+		}
+	}
+
+	return problems
+}
+
+// validateValidity validates the given validity
+// duration and returns the problems found.
+func validateValidity(validity string) []IssueValidationProblem {
+
+	if validity == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(validity)
+	if err != nil {
+		return []IssueValidationProblem{{Field: "validity", Reason: fmt.Sprintf("'%s' is not a valid duration", validity)}}
+	}
+
+	if d <= 0 {
+		return []IssueValidationProblem{{Field: "validity", Reason: "must be greater than zero"}}
+	}
+
+	return nil
+}
+
+// validateNamespace validates the given namespace path.
+func validateNamespace(namespace string) error {
+
+	if !strings.HasPrefix(namespace, "/") {
+		return fmt.Errorf("'%s' must start with /", namespace)
+	}
+
+	if namespace == "/" {
+		return nil
+	}
+
+	if strings.HasSuffix(namespace, "/") {
+		return fmt.Errorf("'%s' must not end with /", namespace)
+	}
+
+	for _, segment := range strings.Split(namespace[1:], "/") {
+		if segment == "" {
+			return fmt.Errorf("'%s' must not contain empty segments", namespace)
+		}
+		if strings.IndexFunc(segment, unicode.IsSpace) >= 0 {
+			return fmt.Errorf("'%s' must not contain spaces", namespace)
+		}
+	}
+
+	return nil
+}
+
+// validatePermission validates the given permission. It must either be
+// a tag like @auth:role=viewer or an identity followed by a list of
+// operations like namespace,get,post.
+func validatePermission(permission string) error {
+
+	if strings.IndexFunc(permission, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("'%s' must not contain spaces", permission)
+	}
+
+	if strings.HasPrefix(permission, "@") {
+		parts := strings.SplitN(permission, "=", 2)
+		if len(parts) != 2 || len(parts[0]) < 2 || parts[1] == "" {
+			return fmt.Errorf("'%s' must be in the form @key=value", permission)
+		}
+		return nil
+	}
+
+	parts := strings.Split(permission, ",")
+	if len(parts) < 2 || parts[0] == "" {
+		return fmt.Errorf("'%s' must be in the form identity,operation[,operation...]", permission)
+	}
+
+	for _, op := range parts[1:] {
+		if _, ok := permissionOperations[strings.ToLower(op)]; !ok {
+			return fmt.Errorf("'%s' contains invalid operation '%s'", permission, op)
+		}
+	}
+
+	return nil
+}
+
+type clientOpts struct {
+	tlsConfig    *tls.Config
+	httpClient   *http.Client
+	roundTripper http.RoundTripper
+	timeout      time.Duration
+	hasTimeout   bool
+	retryPolicy  RetryPolicy
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	disableKeepAlives   bool
+
+	userAgent    string
+	headers      http.Header
+	trackingType string
+	logger       *zap.Logger
+	tracer       Tracer
+	metrics      MetricsRecorder
+}
+
+func newClientOpts() clientOpts {
+
+	return clientOpts{
+		timeout:             30 * time.Second,
+		retryPolicy:         DefaultRetryPolicy(),
+		maxIdleConns:        100,
+		maxIdleConnsPerHost: 16,
+		idleConnTimeout:     90 * time.Second,
+	}
+}
+
+// A ClientOption is the type of various options
+// you can pass to New.
+type ClientOption func(*clientOpts)
+
+// OptClientTLSConfig sets the tls.Config used to connect to midgard.
+// By default, the system cert pool is used to verify the server.
+// It is ignored when OptClientHTTPClient or OptClientRoundTripper is used.
+func OptClientTLSConfig(tlsConfig *tls.Config) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.tlsConfig = tlsConfig
+	}
+}
+
+// OptClientHTTPClient sets the http.Client used to send the requests.
+// The given client is copied and used as is, except for its timeout if
+// OptClientTimeout is also used, and its CheckRedirect, as redirections
+// are never followed.
+func OptClientHTTPClient(httpClient *http.Client) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.httpClient = httpClient
+	}
+}
+
+// OptClientRoundTripper sets the http.RoundTripper used to send the
+// requests instead of the default http.Transport.
+func OptClientRoundTripper(roundTripper http.RoundTripper) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.roundTripper = roundTripper
+	}
+}
+
+// OptClientTimeout sets the timeout of each request sent to midgard.
+// The default is 30s. 0 means no timeout.
+func OptClientTimeout(timeout time.Duration) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.timeout = timeout
+		opts.hasTimeout = true
+	}
+}
+
+// OptClientMaxIdleConns sets the maximum number of idle connections
+// kept open across all the midgard endpoints. The default is 100.
+// 0 means no limit. It is ignored when OptClientHTTPClient or
+// OptClientRoundTripper is used.
+func OptClientMaxIdleConns(n int) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.maxIdleConns = n
+	}
+}
+
+// OptClientMaxIdleConnsPerHost sets the maximum number of idle
+// connections kept open to each midgard endpoint. The default is 16.
+// It is ignored when OptClientHTTPClient or OptClientRoundTripper is used.
+func OptClientMaxIdleConnsPerHost(n int) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.maxIdleConnsPerHost = n
+	}
+}
+
+// OptClientIdleConnTimeout sets how long an idle connection is kept
+// open before being closed. The default is 90s. 0 means no limit.
+// It is ignored when OptClientHTTPClient or OptClientRoundTripper is used.
+func OptClientIdleConnTimeout(timeout time.Duration) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.idleConnTimeout = timeout
+	}
+}
+
+// OptClientDisableKeepAlives makes the client open a new connection
+// for each request. It is ignored when OptClientHTTPClient or
+// OptClientRoundTripper is used.
+func OptClientDisableKeepAlives() ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.disableKeepAlives = true
+	}
+}
+
+// OptClientRetryPolicy sets the RetryPolicy of the client.
+// The default is DefaultRetryPolicy().
+func OptClientRetryPolicy(retryPolicy RetryPolicy) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.retryPolicy = retryPolicy
+	}
+}
+
+// OptClientUserAgent sets the User-Agent header sent with each request.
+func OptClientUserAgent(userAgent string) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.userAgent = userAgent
+	}
+}
+
+// OptClientHeaders sets static headers sent with each request.
+// They never override the headers set by the client itself.
+func OptClientHeaders(headers http.Header) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.headers = headers.Clone()
+	}
+}
+
+// OptClientTrackingType sets the tracking type sent with each request.
+func OptClientTrackingType(trackingType string) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.trackingType = trackingType
+	}
+}
+
+// OptClientLogger sets the logger used by the client.
+// By default, the zap global logger is used.
+func OptClientLogger(logger *zap.Logger) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.logger = logger
+	}
+}
+
+// OptClientTracer sets the Tracer used to trace the requests.
+func OptClientTracer(tracer Tracer) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.tracer = tracer
+	}
+}
+
+// OptClientMetrics sets the MetricsRecorder used to
+// record metrics about the requests.
+func OptClientMetrics(recorder MetricsRecorder) ClientOption {
+
+	return func(opts *clientOpts) {
+		opts.metrics = recorder
+	}
+}
@@ -12,9 +12,13 @@
 package midgardclient
 
 import (
+	"crypto/tls"
+	"net/http"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/zap"
 )
 
 func TestBahamut_Options(t *testing.T) {
@@ -31,8 +35,9 @@ func TestBahamut_Options(t *testing.T) {
 		So(c.quota, ShouldEqual, 0)
 	})
 
-	Convey("Calling OptQuota with a negative value should panic", t, func() {
-		So(func() { OptQuota(-1)(&c) }, ShouldPanicWith, "quota must be a positive number")
+	Convey("Calling OptQuota with a negative value should not panic", t, func() {
+		So(func() { OptQuota(-1)(&c) }, ShouldNotPanic)
+		So(c.quota, ShouldEqual, -1)
 	})
 
 	Convey("Calling OptOpaque should work", t, func() {
@@ -60,3 +65,132 @@ func TestBahamut_Options(t *testing.T) {
 		So(c.restrictedNetworks, ShouldResemble, []string{"1.0.0.0/8", "2.0.0.0/8"})
 	})
 }
+
+func TestClient_Options(t *testing.T) {
+
+	c := newClientOpts()
+
+	Convey("Calling newClientOpts should set the defaults", t, func() {
+		So(c.timeout, ShouldEqual, 30*time.Second)
+		So(c.hasTimeout, ShouldBeFalse)
+		So(c.retryPolicy, ShouldResemble, DefaultRetryPolicy())
+		So(c.maxIdleConns, ShouldEqual, 100)
+		So(c.maxIdleConnsPerHost, ShouldEqual, 16)
+		So(c.idleConnTimeout, ShouldEqual, 90*time.Second)
+		So(c.disableKeepAlives, ShouldBeFalse)
+	})
+
+	Convey("Calling OptClientTLSConfig should work", t, func() {
+		tlsConfig := &tls.Config{}
+		OptClientTLSConfig(tlsConfig)(&c)
+		So(c.tlsConfig, ShouldEqual, tlsConfig)
+	})
+
+	Convey("Calling OptClientHTTPClient should work", t, func() {
+		httpClient := &http.Client{}
+		OptClientHTTPClient(httpClient)(&c)
+		So(c.httpClient, ShouldEqual, httpClient)
+	})
+
+	Convey("Calling OptClientRoundTripper should work", t, func() {
+		transport := &http.Transport{}
+		OptClientRoundTripper(transport)(&c)
+		So(c.roundTripper, ShouldEqual, transport)
+	})
+
+	Convey("Calling OptClientTimeout should work", t, func() {
+		OptClientTimeout(0)(&c)
+		So(c.timeout, ShouldEqual, 0)
+		So(c.hasTimeout, ShouldBeTrue)
+	})
+
+	Convey("Calling the idle connection options should work", t, func() {
+		OptClientMaxIdleConns(10)(&c)
+		OptClientMaxIdleConnsPerHost(5)(&c)
+		OptClientIdleConnTimeout(time.Minute)(&c)
+		OptClientDisableKeepAlives()(&c)
+		So(c.maxIdleConns, ShouldEqual, 10)
+		So(c.maxIdleConnsPerHost, ShouldEqual, 5)
+		So(c.idleConnTimeout, ShouldEqual, time.Minute)
+		So(c.disableKeepAlives, ShouldBeTrue)
+	})
+
+	Convey("Calling OptClientUserAgent should work", t, func() {
+		OptClientUserAgent("agent")(&c)
+		So(c.userAgent, ShouldEqual, "agent")
+	})
+
+	Convey("Calling OptClientHeaders should copy the headers", t, func() {
+		headers := http.Header{"A": []string{"b"}}
+		OptClientHeaders(headers)(&c)
+		headers.Set("A", "c")
+		So(c.headers, ShouldResemble, http.Header{"A": []string{"b"}})
+	})
+
+	Convey("Calling OptClientTrackingType should work", t, func() {
+		OptClientTrackingType("type")(&c)
+		So(c.trackingType, ShouldEqual, "type")
+	})
+
+	Convey("Calling OptClientLogger should work", t, func() {
+		logger := zap.NewNop()
+		OptClientLogger(logger)(&c)
+		So(c.logger, ShouldEqual, logger)
+	})
+}
+
+func TestIssueOptions_validate(t *testing.T) {
+
+	Convey("Given I have valid issue options", t, func() {
+
+		opts := issueOpts{
+			quota:                 1,
+			restrictedNamespace:   "/a/b",
+			restrictedPermissions: []string{"@auth:role=viewer", "namespace,get,POST", "*,*"},
+			restrictedNetworks:    []string{"10.0.0.0/8", "::1/128"},
+		}
+
+		Convey("Then there should be no problem", func() {
+			So(validateIssueOpts(opts), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given I have issue options with a validity", t, func() {
+
+		opts := issueOpts{
+			validity: time.Minute,
+		}
+
+		Convey("Then the validity should be rejected", func() {
+			So(validateIssueOpts(opts), ShouldResemble, []IssueValidationProblem{{Field: "validity", Reason: "OptValidity is only supported by Downscope"}})
+		})
+	})
+
+	Convey("Given I have namespaces", t, func() {
+		So(validateNamespace("/"), ShouldBeNil)
+		So(validateNamespace("/a"), ShouldBeNil)
+		So(validateNamespace("a").Error(), ShouldEqual, "'a' must start with /")
+		So(validateNamespace("/a/").Error(), ShouldEqual, "'/a/' must not end with /")
+		So(validateNamespace("/a//b").Error(), ShouldEqual, "'/a//b' must not contain empty segments")
+		So(validateNamespace("/a b").Error(), ShouldEqual, "'/a b' must not contain spaces")
+	})
+
+	Convey("Given I have permissions", t, func() {
+		So(validatePermission("@auth:role=viewer"), ShouldBeNil)
+		So(validatePermission("test,get,post,put"), ShouldBeNil)
+		So(validatePermission("@auth:role").Error(), ShouldEqual, "'@auth:role' must be in the form @key=value")
+		So(validatePermission("@=a").Error(), ShouldEqual, "'@=a' must be in the form @key=value")
+		So(validatePermission("namespace").Error(), ShouldEqual, "'namespace' must be in the form identity,operation[,operation...]")
+		So(validatePermission(",get").Error(), ShouldEqual, "',get' must be in the form identity,operation[,operation...]")
+		So(validatePermission("namespace,fly").Error(), ShouldEqual, "'namespace,fly' contains invalid operation 'fly'")
+		So(validatePermission("namespace, get").Error(), ShouldEqual, "'namespace, get' must not contain spaces")
+	})
+
+	Convey("Given I have validities", t, func() {
+		So(validateValidity(""), ShouldBeEmpty)
+		So(validateValidity("1h"), ShouldBeEmpty)
+		So(validateValidity("0s"), ShouldResemble, []IssueValidationProblem{{Field: "validity", Reason: "must be greater than zero"}})
+		So(validateValidity("-1h"), ShouldResemble, []IssueValidationProblem{{Field: "validity", Reason: "must be greater than zero"}})
+		So(validateValidity("abc"), ShouldResemble, []IssueValidationProblem{{Field: "validity", Reason: "'abc' is not a valid duration"}})
+	})
+}
@@ -0,0 +1,303 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.aporeto.io/gaia"
+	"go.aporeto.io/midgard-lib/ldaputils"
+)
+
+// A RealmDescriptor describes the metadata midgard
+// expects to issue a token from a realm.
+type RealmDescriptor struct {
+
+	// Realm is the name of the realm.
+	Realm gaia.IssueRealmValue
+
+	// RequiredMetadata lists the metadata keys
+	// that must be set to a non empty value.
+	RequiredMetadata []string
+
+	// SecretMetadata lists the metadata keys holding secrets.
+	// Their values are snipped from the errors.
+	SecretMetadata []string
+
+	// Validate, if set, validates the metadata locally
+	// once the required metadata has been checked.
+	Validate func(metadata map[string]interface{}) error
+}
+
+// validate validates the given metadata according
+// to the descriptor and returns the problems found.
+func (d RealmDescriptor) validate(metadata map[string]interface{}) []IssueValidationProblem {
+
+	var problems []IssueValidationProblem
+
+	for _, key := range d.RequiredMetadata {
+		if isEmptyMetadata(metadata[key]) {
+			problems = append(problems, IssueValidationProblem{Field: "metadata." + key, Reason: "required"})
+		}
+	}
+
+	if d.Validate == nil {
+		return problems
+	}
+
+	if err := d.Validate(metadata); err != nil {
+		var verr *IssueValidationError
+		if errors.As(err, &verr) {
+			return append(problems, verr.Problems...)
+		}
+		problems = append(problems, IssueValidationProblem{Field: "metadata", Reason: err.Error()})
+	}
+
+	return problems
+}
+
+// secrets returns the values of the secret metadata.
+func (d RealmDescriptor) secrets(metadata map[string]interface{}) []string {
+
+	var out []string
+	for _, key := range d.SecretMetadata {
+		if s, ok := metadata[key].(string); ok && s != "" {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+// An IssueValidationProblem describes a problem
+// found while validating an issue request.
+type IssueValidationProblem struct {
+	Field  string
+	Reason string
+}
+
+// An IssueValidationError is returned when an issue request is rejected
+// locally before being sent. It lists every problem found.
+type IssueValidationError struct {
+	Realm    string
+	Problems []IssueValidationProblem
+}
+
+func (e *IssueValidationError) Error() string {
+
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.Field + ": " + p.Reason
+	}
+
+	return fmt.Sprintf("invalid issue request for realm '%s': %s", e.Realm, strings.Join(problems, ", "))
+}
+
+var (
+	realmsRegistry     = map[gaia.IssueRealmValue]RealmDescriptor{}
+	realmsRegistryLock sync.RWMutex
+)
+
+func init() {
+
+	for _, d := range []RealmDescriptor{
+		{
+			Realm: gaia.IssueRealmCertificate,
+		},
+		{
+			Realm: gaia.IssueRealmGoogle,
+		},
+		{
+			Realm:            gaia.IssueRealmLDAP,
+			RequiredMetadata: []string{ldaputils.LDAPUsernameKey, ldaputils.LDAPPasswordKey},
+			SecretMetadata:   []string{ldaputils.LDAPPasswordKey, ldaputils.LDAPBindPasswordKey},
+		},
+		{
+			Realm:            gaia.IssueRealmVince,
+			RequiredMetadata: []string{"vinceAccount", "vincePassword"},
+			SecretMetadata:   []string{"vincePassword", "vinceOTP"},
+		},
+		{
+			Realm:            gaia.IssueRealmAporetoIdentityToken,
+			RequiredMetadata: []string{"token"},
+			SecretMetadata:   []string{"token"},
+		},
+		{
+			Realm:            gaia.IssueRealmAWSSecurityToken,
+			RequiredMetadata: []string{"accessKeyID", "secretAccessKey"},
+			SecretMetadata:   []string{"secretAccessKey", "token"},
+		},
+		{
+			Realm:            gaia.IssueRealmGCPIdentityToken,
+			RequiredMetadata: []string{"token"},
+			SecretMetadata:   []string{"token"},
+		},
+		{
+			Realm:            gaia.IssueRealmAzureIdentityToken,
+			RequiredMetadata: []string{"token"},
+			SecretMetadata:   []string{"token"},
+		},
+		{
+			Realm:            gaia.IssueRealmPCIdentityToken,
+			RequiredMetadata: []string{"token"},
+			SecretMetadata:   []string{"token"},
+		},
+		{
+			Realm:          gaia.IssueRealmOIDC,
+			SecretMetadata: []string{"code"},
+			Validate:       validateTwoStepsMetadata("code", "state"),
+		},
+		{
+			Realm:          gaia.IssueRealmSAML,
+			SecretMetadata: []string{"SAMLResponse"},
+			Validate:       validateTwoStepsMetadata("SAMLResponse"),
+		},
+	} {
+		RegisterRealm(d)
+	}
+}
+
+// RegisterRealm registers the given RealmDescriptor, replacing
+// the descriptor previously registered for the same realm.
+func RegisterRealm(descriptor RealmDescriptor) {
+
+	if descriptor.Realm == "" {
+		panic("realm cannot be empty")
+	}
+
+	realmsRegistryLock.Lock()
+	realmsRegistry[descriptor.Realm] = descriptor
+	realmsRegistryLock.Unlock()
+}
+
+// LookupRealm returns the RealmDescriptor registered for the given realm.
+func LookupRealm(realm gaia.IssueRealmValue) (RealmDescriptor, bool) {
+
+	realmsRegistryLock.RLock()
+	defer realmsRegistryLock.RUnlock()
+
+	d, ok := realmsRegistry[realm]
+
+	return d, ok
+}
+
+// RegisteredRealms returns the sorted list of the registered realms.
+func RegisteredRealms() []gaia.IssueRealmValue {
+
+	realmsRegistryLock.RLock()
+	defer realmsRegistryLock.RUnlock()
+
+	realms := make([]gaia.IssueRealmValue, 0, len(realmsRegistry))
+	for realm := range realmsRegistry {
+		realms = append(realms, realm)
+	}
+
+	sort.Slice(realms, func(i, j int) bool { return realms[i] < realms[j] })
+
+	return realms
+}
+
+// Issue issues a Midgard jwt from the given realm with the given metadata
+// for the given validity duration. If the realm is registered, the metadata
+// is validated locally according to its RealmDescriptor before sending the
+// request. Realms that are not registered are sent as is. The validity and
+// the options are always validated, and an IssueValidationError listing
+// every problem is returned if they are not valid.
+func (a *Client) Issue(ctx context.Context, realm gaia.IssueRealmValue, metadata map[string]interface{}, validity time.Duration, options ...Option) (string, error) {
+
+	issueRequest := gaia.NewIssue()
+	issueRequest.Realm = realm
+	issueRequest.Validity = validity.String()
+	issueRequest.Metadata = make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		issueRequest.Metadata[k] = v
+	}
+
+	return a.issue(ctx, "midgardlib.client.issue."+strings.ToLower(string(realm)), issueRequest, options)
+}
+
+// issue validates the given issue request according to the descriptor
+// of its realm, applies the given options and sends it to midgard.
+func (a *Client) issue(ctx context.Context, spanName string, issueRequest *gaia.Issue, options []Option) (string, error) {
+
+	opts := issueOpts{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	descriptor, _ := LookupRealm(issueRequest.Realm)
+
+	problems := descriptor.validate(issueRequest.Metadata)
+	problems = append(problems, validateValidity(issueRequest.Validity)...)
+	problems = append(problems, validateIssueOpts(opts)...)
+
+	if len(problems) > 0 {
+		return "", &IssueValidationError{Realm: string(issueRequest.Realm), Problems: problems}
+	}
+
+	applyOptions(issueRequest, opts)
+
+	span, subctx := a.tracer().StartSpan(ctx, spanName)
+	defer span.Finish()
+
+	span.SetTag("realm", string(issueRequest.Realm))
+
+	return a.sendRequest(subctx, issueRequest, descriptor.secrets(issueRequest.Metadata)...)
+}
+
+// validateTwoStepsMetadata returns a function validating the metadata of
+// realms issuing tokens in two steps. The first step requires a redirect
+// URL and the second one requires the given keys.
+func validateTwoStepsMetadata(step2Keys ...string) func(map[string]interface{}) error {
+
+	return func(metadata map[string]interface{}) error {
+
+		var problems []IssueValidationProblem
+
+		if _, ok := metadata[step2Keys[0]]; !ok {
+			if isEmptyMetadata(metadata["redirectURL"]) {
+				problems = append(problems, IssueValidationProblem{Field: "metadata.redirectURL", Reason: "required"})
+			}
+		} else {
+			for _, key := range step2Keys {
+				if isEmptyMetadata(metadata[key]) {
+					problems = append(problems, IssueValidationProblem{Field: "metadata." + key, Reason: "required"})
+				}
+			}
+		}
+
+		if len(problems) > 0 {
+			return &IssueValidationError{Problems: problems}
+		}
+
+		return nil
+	}
+}
+
+// isEmptyMetadata returns true if the given metadata value is not set.
+func isEmptyMetadata(value interface{}) bool {
+
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	default:
+		return false
+	}
+}
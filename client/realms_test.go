@@ -0,0 +1,237 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia"
+)
+
+func TestRealms_Registry(t *testing.T) {
+
+	Convey("Given I have the default registry", t, func() {
+
+		Convey("Then the builtin realms should be registered", func() {
+			realms := RegisteredRealms()
+			So(realms, ShouldContain, gaia.IssueRealmCertificate)
+			So(realms, ShouldContain, gaia.IssueRealmOIDC)
+			So(realms, ShouldContain, gaia.IssueRealmVince)
+
+			d, ok := LookupRealm(gaia.IssueRealmVince)
+			So(ok, ShouldBeTrue)
+			So(d.RequiredMetadata, ShouldResemble, []string{"vinceAccount", "vincePassword"})
+		})
+
+		Convey("Then I should not find an unknown realm", func() {
+			_, ok := LookupRealm("Unknown")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Then registering an empty realm should panic", func() {
+			So(func() { RegisterRealm(RealmDescriptor{}) }, ShouldPanicWith, "realm cannot be empty")
+		})
+	})
+}
+
+func TestRealms_validate(t *testing.T) {
+
+	Convey("Given I have a realm descriptor", t, func() {
+
+		d := RealmDescriptor{
+			Realm:            "Test",
+			RequiredMetadata: []string{"a"},
+			SecretMetadata:   []string{"a", "b"},
+			Validate: func(metadata map[string]interface{}) error {
+				if metadata["a"] == "bad" {
+					return fmt.Errorf("a cannot be bad")
+				}
+				return nil
+			},
+		}
+
+		Convey("Then valid metadata should be accepted", func() {
+			So(d.validate(map[string]interface{}{"a": "good"}), ShouldBeEmpty)
+		})
+
+		Convey("Then missing metadata should be rejected", func() {
+			So(d.validate(map[string]interface{}{"a": ""}), ShouldResemble, []IssueValidationProblem{
+				{Field: "metadata.a", Reason: "required"},
+			})
+		})
+
+		Convey("Then metadata rejected by the hook should be rejected", func() {
+			So(d.validate(map[string]interface{}{"a": "bad"}), ShouldResemble, []IssueValidationProblem{
+				{Field: "metadata", Reason: "a cannot be bad"},
+			})
+		})
+
+		Convey("Then the secrets should be returned", func() {
+			So(d.secrets(map[string]interface{}{"a": "x", "b": "", "c": "z"}), ShouldResemble, []string{"x"})
+		})
+	})
+
+	Convey("Given I have the OIDC realm descriptor", t, func() {
+
+		d, _ := LookupRealm(gaia.IssueRealmOIDC)
+
+		Convey("Then both steps should be validated", func() {
+			So(d.validate(map[string]interface{}{"redirectURL": "http://ici"}), ShouldBeEmpty)
+			So(d.validate(map[string]interface{}{"code": "code", "state": "state"}), ShouldBeEmpty)
+			So(d.validate(map[string]interface{}{}), ShouldResemble, []IssueValidationProblem{
+				{Field: "metadata.redirectURL", Reason: "required"},
+			})
+			So(d.validate(map[string]interface{}{"code": "code"}), ShouldResemble, []IssueValidationProblem{
+				{Field: "metadata.state", Reason: "required"},
+			})
+		})
+	})
+}
+
+func TestClient_Issue(t *testing.T) {
+
+	Convey("Given I have a client and a fake server", t, func() {
+
+		var called int32
+		var received *gaia.Issue
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			received = gaia.NewIssue()
+			_ = json.NewDecoder(r.Body).Decode(received)
+			fmt.Fprintln(w, `{"token": "yeay!", "metadata": {"extra": "data"}}`)
+		}))
+		defer ts.Close()
+
+		cl := NewClient(ts.URL)
+
+		Convey("When I issue a token from a realm the client does not know", func() {
+
+			metadata := map[string]interface{}{"key": "value"}
+			token, err := cl.Issue(context.Background(), "Unknown", metadata, time.Minute, OptQuota(2))
+
+			Convey("Then the request should be sent as is", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "yeay!")
+				So(received.Realm, ShouldEqual, "Unknown")
+				So(received.Metadata, ShouldResemble, map[string]interface{}{"key": "value"})
+				So(received.Validity, ShouldEqual, "1m0s")
+				So(received.Quota, ShouldEqual, 2)
+			})
+
+			Convey("Then the given metadata should not be modified", func() {
+				So(metadata, ShouldResemble, map[string]interface{}{"key": "value"})
+			})
+		})
+
+		Convey("When I issue a token with missing required metadata", func() {
+
+			_, err := cl.Issue(context.Background(), gaia.IssueRealmAporetoIdentityToken, nil, time.Minute)
+
+			Convey("Then err should be an IssueValidationError", func() {
+				var verr *IssueValidationError
+				So(errors.As(err, &verr), ShouldBeTrue)
+				So(verr.Realm, ShouldEqual, "AporetoIdentityToken")
+				So(verr.Problems, ShouldResemble, []IssueValidationProblem{{Field: "metadata.token", Reason: "required"}})
+			})
+
+			Convey("Then the request should not have been sent", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I issue a token with invalid validity and options", func() {
+
+			_, err := cl.Issue(
+				context.Background(),
+				gaia.IssueRealmVince,
+				map[string]interface{}{"vinceAccount": "account"},
+				0,
+				OptQuota(-1),
+				OptRestrictNamespace("a/b"),
+				OptRestrictPermissions([]string{"@auth:role=viewer", "namespace,get,fly"}),
+				OptRestrictNetworks([]string{"10.0.0.0/8", "10.0.0.300/8"}),
+			)
+
+			Convey("Then err should list every problem", func() {
+				var verr *IssueValidationError
+				So(errors.As(err, &verr), ShouldBeTrue)
+				So(verr.Problems, ShouldResemble, []IssueValidationProblem{
+					{Field: "metadata.vincePassword", Reason: "required"},
+					{Field: "validity", Reason: "must be greater than zero"},
+					{Field: "quota", Reason: "must be a positive number"},
+					{Field: "restrictedNamespace", Reason: "'a/b' must start with /"},
+					{Field: "restrictedPermissions[1]", Reason: "'namespace,get,fly' contains invalid operation 'fly'"},
+					{Field: "restrictedNetworks[1]", Reason: "'10.0.0.300/8' is not a valid CIDR"},
+				})
+				So(atomic.LoadInt32(&called), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I issue a token with a validity option", func() {
+
+			_, err := cl.IssueFromCertificate(context.Background(), time.Minute, OptValidity(time.Hour))
+
+			Convey("Then err should be an IssueValidationError", func() {
+				var verr *IssueValidationError
+				So(errors.As(err, &verr), ShouldBeTrue)
+				So(verr.Problems, ShouldResemble, []IssueValidationProblem{{Field: "validity", Reason: "OptValidity is only supported by Downscope"}})
+				So(atomic.LoadInt32(&called), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I issue a token from a registered custom realm", func() {
+
+			RegisterRealm(RealmDescriptor{
+				Realm: "Custom",
+				Validate: func(metadata map[string]interface{}) error {
+					return fmt.Errorf("nope")
+				},
+			})
+
+			_, err := cl.Issue(context.Background(), "Custom", nil, time.Minute)
+
+			Convey("Then the validation hook should be called", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "invalid issue request for realm 'Custom': metadata: nope")
+				So(atomic.LoadInt32(&called), ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("Given I have a client with an unreachable server", t, func() {
+
+		p := DefaultRetryPolicy()
+		p.MaxAttempts = 1
+		cl := NewClientWithRetryPolicy("http://127.0.0.1:1/s3cr3t", nil, p)
+
+		Convey("When I issue a token with secret metadata", func() {
+
+			_, err := cl.Issue(context.Background(), gaia.IssueRealmPCIdentityToken, map[string]interface{}{"token": "s3cr3t"}, time.Minute)
+
+			Convey("Then the secret should be snipped from the error", func() {
+				var terr *TransportError
+				So(errors.As(err, &terr), ShouldBeTrue)
+				So(err.Error(), ShouldNotContainSubstring, "s3cr3t")
+				So(err.Error(), ShouldContainSubstring, "[snip]")
+			})
+		})
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"go.aporeto.io/gaia/types"
+)
+
+// Restrictions contains the restrictions of a token.
+type Restrictions struct {
+	Namespace   string   `json:"namespace,omitempty"`
+	Permissions []string `json:"perms,omitempty"`
+	Networks    []string `json:"networks,omitempty"`
+}
+
+// AllowsSourceIP returns true if the token can be used from the given
+// IP. It is always true if the token is not restricted to networks.
+// Invalid networks never match.
+func (r Restrictions) AllowsSourceIP(ip net.IP) bool {
+
+	if len(r.Networks) == 0 {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range r.Networks {
+		if _, ipnet, err := net.ParseCIDR(network); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsNamespace returns true if the token can be used in the given
+// namespace, that is the restricted namespace or one of its children.
+// It is always true if the token is not restricted to a namespace.
+func (r Restrictions) AllowsNamespace(namespace string) bool {
+
+	if r.Namespace == "" {
+		return true
+	}
+
+	return matchNamespacePrefix(namespace, []string{r.Namespace})
+}
+
+// AllowsPermission returns true if the token can be used to perform the
+// given operation on the given identity. It is always true if the token
+// is not restricted to permissions. Identities and operations are case
+// insensitive and * matches any of them.
+//
+// Permissions given as tags, like @auth:role=viewer, refer to roles
+// defined on the server and cannot be evaluated locally: they never
+// match.
+func (r Restrictions) AllowsPermission(identity string, operation string) bool {
+
+	if len(r.Permissions) == 0 {
+		return true
+	}
+
+	for _, permission := range r.Permissions {
+
+		if strings.HasPrefix(permission, "@") {
+			continue
+		}
+
+		parts := strings.Split(permission, ",")
+		if len(parts) < 2 || !matchPermissionPart(parts[0], identity) {
+			continue
+		}
+
+		for _, op := range parts[1:] {
+			if matchPermissionPart(op, operation) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// A RestrictedNetworkError is returned when the token
+// is used from an IP it is not restricted to.
+type RestrictedNetworkError struct {
+	IP       net.IP
+	Networks []string
+}
+
+func (e *RestrictedNetworkError) Error() string {
+
+	return fmt.Sprintf("token cannot be used from '%s': expected one of '%s'", e.IP, strings.Join(e.Networks, "', '"))
+}
+
+// matchPermissionPart returns true if the given
+// part of a permission matches the given value.
+func matchPermissionPart(part string, value string) bool {
+
+	part = strings.TrimSpace(part)
+
+	return part == "*" || strings.EqualFold(part, value)
+}
+
+// RestrictionsFromMidgardClaims returns the restrictions of the given
+// claims, like the ones returned by MidgardClaimsFromContext.
+func RestrictionsFromMidgardClaims(c *types.MidgardClaims) Restrictions {
+
+	if c == nil || c.Restrictions == nil {
+		return Restrictions{}
+	}
+
+	return Restrictions{
+		Namespace:   c.Restrictions.Namespace,
+		Permissions: append([]string(nil), c.Restrictions.Permissions...),
+		Networks:    append([]string(nil), c.Restrictions.Networks...),
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia/types"
+)
+
+func TestRestrictions_AllowsSourceIP(t *testing.T) {
+
+	Convey("Given I have restrictions without networks", t, func() {
+
+		r := Restrictions{}
+
+		Convey("Then any IP should be allowed", func() {
+			So(r.AllowsSourceIP(net.ParseIP("10.0.0.1")), ShouldBeTrue)
+			So(r.AllowsSourceIP(nil), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given I have restrictions with networks", t, func() {
+
+		r := Restrictions{Networks: []string{"10.0.0.0/8", "not-a-cidr", "2001:db8::/32"}}
+
+		Convey("Then the IPs in the networks should be allowed", func() {
+			So(r.AllowsSourceIP(net.ParseIP("10.1.2.3")), ShouldBeTrue)
+			So(r.AllowsSourceIP(net.ParseIP("2001:db8::1")), ShouldBeTrue)
+		})
+
+		Convey("Then the other IPs should not be allowed", func() {
+			So(r.AllowsSourceIP(net.ParseIP("192.168.1.1")), ShouldBeFalse)
+			So(r.AllowsSourceIP(net.ParseIP("2001:db9::1")), ShouldBeFalse)
+			So(r.AllowsSourceIP(nil), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRestrictions_AllowsNamespace(t *testing.T) {
+
+	Convey("Given I have restrictions without namespace", t, func() {
+
+		r := Restrictions{}
+
+		Convey("Then any namespace should be allowed", func() {
+			So(r.AllowsNamespace("/a"), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given I have restrictions with a namespace", t, func() {
+
+		r := Restrictions{Namespace: "/a/b"}
+
+		Convey("Then the namespace and its children should be allowed", func() {
+			So(r.AllowsNamespace("/a/b"), ShouldBeTrue)
+			So(r.AllowsNamespace("/a/b/c"), ShouldBeTrue)
+		})
+
+		Convey("Then the other namespaces should not be allowed", func() {
+			So(r.AllowsNamespace("/a"), ShouldBeFalse)
+			So(r.AllowsNamespace("/a/bc"), ShouldBeFalse)
+			So(r.AllowsNamespace("/x/b"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRestrictions_AllowsPermission(t *testing.T) {
+
+	Convey("Given I have restrictions without permissions", t, func() {
+
+		r := Restrictions{}
+
+		Convey("Then any permission should be allowed", func() {
+			So(r.AllowsPermission("processingunit", "delete"), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given I have restrictions with permissions", t, func() {
+
+		r := Restrictions{Permissions: []string{
+			"processingunit,get,post",
+			"enforcer,*",
+			"*,head",
+			"@auth:role=viewer",
+		}}
+
+		Convey("Then the listed permissions should be allowed", func() {
+			So(r.AllowsPermission("processingunit", "get"), ShouldBeTrue)
+			So(r.AllowsPermission("ProcessingUnit", "POST"), ShouldBeTrue)
+			So(r.AllowsPermission("enforcer", "delete"), ShouldBeTrue)
+			So(r.AllowsPermission("namespace", "head"), ShouldBeTrue)
+		})
+
+		Convey("Then the other permissions should not be allowed", func() {
+			So(r.AllowsPermission("processingunit", "delete"), ShouldBeFalse)
+			So(r.AllowsPermission("namespace", "get"), ShouldBeFalse)
+			So(r.AllowsPermission("@auth:role", "viewer"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRestrictions_FromMidgardClaims(t *testing.T) {
+
+	Convey("Given I have midgard claims with restrictions", t, func() {
+
+		c := &types.MidgardClaims{
+			Restrictions: &types.MidgardClaimsRestrictions{
+				Namespace: "/a",
+				Networks:  []string{"10.0.0.0/8"},
+			},
+		}
+
+		Convey("When I decode the restrictions", func() {
+
+			r := RestrictionsFromMidgardClaims(c)
+
+			Convey("Then they should be correct", func() {
+				So(r, ShouldResemble, Restrictions{Namespace: "/a", Networks: []string{"10.0.0.0/8"}})
+			})
+		})
+	})
+
+	Convey("Given I have nil midgard claims", t, func() {
+
+		r := RestrictionsFromMidgardClaims(nil)
+
+		Convey("Then the restrictions should be empty", func() {
+			So(r, ShouldResemble, Restrictions{})
+		})
+	})
+}
@@ -0,0 +1,276 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// An ErrorClass represents a class of transport errors
+// that can be retried by a RetryPolicy.
+type ErrorClass int
+
+// Various values of ErrorClass.
+const (
+	// ErrorClassTimeout matches dial, TLS handshake and response timeouts.
+	ErrorClassTimeout ErrorClass = 1 << iota
+
+	// ErrorClassNetwork matches network errors like refused or
+	// reset connections and DNS resolution failures.
+	ErrorClassNetwork
+
+	// ErrorClassEOF matches connections closed by the server
+	// before a response was received.
+	ErrorClassEOF
+
+	// ErrorClassOther matches any other transport error.
+	ErrorClassOther
+
+	// ErrorClassAll matches all transport errors.
+	ErrorClassAll = ErrorClassTimeout | ErrorClassNetwork | ErrorClassEOF | ErrorClassOther
+)
+
+// A RetryPolicy configures how the Client retries
+// requests sent to midgard.
+//
+// TLS errors are never retried.
+type RetryPolicy struct {
+
+	// MaxAttempts is the maximum number of attempts, including
+	// the first one. 0 means the client retries until the
+	// context is done.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between two attempts,
+	// including the one given by a Retry-After header.
+	MaxBackoff time.Duration
+
+	// Multiplier is the factor applied to the backoff after
+	// each attempt. Values lower than 1 are treated as 1.
+	Multiplier float64
+
+	// Jitter is the fraction of the backoff that is randomized,
+	// between 0 (no jitter) and 1 (full jitter).
+	Jitter float64
+
+	// HonorRetryAfter makes the client wait for the duration
+	// given in the Retry-After header of a retryable response,
+	// up to MaxBackoff, instead of the computed backoff.
+	HonorRetryAfter bool
+
+	// RetryableStatusCodes is the list of response status codes
+	// that will be retried.
+	RetryableStatusCodes []int
+
+	// RetryableErrors is the set of transport error classes
+	// that will be retried.
+	RetryableErrors ErrorClass
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used by
+// the Client when none is provided.
+func DefaultRetryPolicy() RetryPolicy {
+
+	return RetryPolicy{
+		MaxAttempts:     5,
+		InitialBackoff:  1 * time.Second,
+		MaxBackoff:      30 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.5,
+		HonorRetryAfter: true,
+		RetryableStatusCodes: []int{
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+		RetryableErrors: ErrorClassAll,
+	}
+}
+
+// shouldRetryStatus returns true if the given status code can be retried.
+func (p RetryPolicy) shouldRetryStatus(code int) bool {
+
+	for _, c := range p.RetryableStatusCodes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shouldRetryClass returns true if transport errors
+// of the given class can be retried.
+func (p RetryPolicy) shouldRetryClass(class ErrorClass) bool {
+
+	return p.RetryableErrors&class != 0
+}
+
+// attemptsExhausted returns true if no more attempt should
+// be done after the given number of attempts.
+func (p RetryPolicy) attemptsExhausted(attempts int) bool {
+
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// backoff returns the delay to wait after the given attempt.
+// The attempt number starts at 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	jitter := p.Jitter
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+
+	if jitter > 0 {
+		delay -= delay * jitter * randFloat64()
+	}
+
+	return time.Duration(delay)
+}
+
+// delay returns the delay to wait before retrying after
+// the given attempt that returned the given response.
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+
+	if p.HonorRetryAfter && resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			if p.MaxBackoff > 0 && d > p.MaxBackoff {
+				return p.MaxBackoff
+			}
+			return d
+		}
+	}
+
+	return p.backoff(attempt)
+}
+
+// parseRetryAfter parses the value of a Retry-After header,
+// either in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if d := date.Sub(now); d > 0 {
+		return d, true
+	}
+
+	return 0, true
+}
+
+// classifyError returns the ErrorClass of the given transport error.
+// It returns 0 for TLS errors, as they must never be retried.
+func classifyError(err error) ErrorClass {
+
+	if isTLSError(err) {
+		return 0
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return ErrorClassTimeout
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorClassEOF
+	}
+
+	var operr *net.OpError
+	var dnserr *net.DNSError
+	if errors.As(err, &operr) || errors.As(err, &dnserr) {
+		return ErrorClassNetwork
+	}
+
+	return ErrorClassOther
+}
+
+// isTLSError returns true if the given error is
+// a certificate verification or TLS handshake error.
+func isTLSError(err error) bool {
+
+	var (
+		uaerr x509.UnknownAuthorityError
+		cierr x509.CertificateInvalidError
+		hnerr x509.HostnameError
+		srerr x509.SystemRootsError
+		rherr tls.RecordHeaderError
+		operr *net.OpError
+	)
+
+	switch {
+	case errors.As(err, &uaerr),
+		errors.As(err, &cierr),
+		errors.As(err, &hnerr),
+		errors.As(err, &srerr),
+		errors.As(err, &rherr):
+		return true
+	case errors.As(err, &operr):
+		// TLS alerts sent by the server are
+		// returned as a remote error.
+		return operr.Op == "remote error"
+	}
+
+	return false
+}
+
+var (
+	jitterRand     = rand.New(rand.NewSource(time.Now().UnixNano())) // #nosec G404
+	jitterRandLock sync.Mutex
+)
+
+func randFloat64() float64 {
+
+	jitterRandLock.Lock()
+	defer jitterRandLock.Unlock()
+
+	return jitterRand.Float64()
+}
@@ -0,0 +1,306 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia"
+)
+
+func TestRetryPolicy_backoff(t *testing.T) {
+
+	Convey("Given I have a retry policy without jitter", t, func() {
+
+		p := RetryPolicy{
+			InitialBackoff: 100 * time.Millisecond,
+			MaxBackoff:     1 * time.Second,
+			Multiplier:     2,
+		}
+
+		Convey("Then the backoff should grow exponentially", func() {
+			So(p.backoff(1), ShouldEqual, 100*time.Millisecond)
+			So(p.backoff(2), ShouldEqual, 200*time.Millisecond)
+			So(p.backoff(3), ShouldEqual, 400*time.Millisecond)
+		})
+
+		Convey("Then the backoff should be capped", func() {
+			So(p.backoff(10), ShouldEqual, 1*time.Second)
+		})
+	})
+
+	Convey("Given I have a retry policy with a multiplier lower than 1", t, func() {
+
+		p := RetryPolicy{
+			InitialBackoff: 100 * time.Millisecond,
+		}
+
+		Convey("Then the backoff should be constant", func() {
+			So(p.backoff(1), ShouldEqual, 100*time.Millisecond)
+			So(p.backoff(5), ShouldEqual, 100*time.Millisecond)
+		})
+	})
+
+	Convey("Given I have a retry policy with jitter", t, func() {
+
+		p := RetryPolicy{
+			InitialBackoff: 100 * time.Millisecond,
+			Multiplier:     1,
+			Jitter:         0.5,
+		}
+
+		Convey("Then the backoff should be within bounds", func() {
+			for i := 0; i < 100; i++ {
+				d := p.backoff(1)
+				So(d, ShouldBeLessThanOrEqualTo, 100*time.Millisecond)
+				So(d, ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+			}
+		})
+	})
+}
+
+func TestRetryPolicy_delay(t *testing.T) {
+
+	Convey("Given I have a retry policy honoring Retry-After", t, func() {
+
+		p := RetryPolicy{
+			InitialBackoff:  100 * time.Millisecond,
+			MaxBackoff:      1 * time.Second,
+			Multiplier:      1,
+			HonorRetryAfter: true,
+		}
+
+		resp := func(retryAfter string) *http.Response {
+			return &http.Response{Header: http.Header{"Retry-After": {retryAfter}}}
+		}
+
+		Convey("Then the Retry-After should be used", func() {
+			So(p.delay(1, resp("0")), ShouldEqual, 0)
+		})
+
+		Convey("Then the Retry-After should be capped", func() {
+			So(p.delay(1, resp("3600")), ShouldEqual, 1*time.Second)
+		})
+
+		Convey("Then the backoff should be used without Retry-After", func() {
+			So(p.delay(1, resp("")), ShouldEqual, 100*time.Millisecond)
+		})
+	})
+}
+
+func TestRetryPolicy_DefaultRetryPolicy(t *testing.T) {
+
+	Convey("Given I have the default retry policy", t, func() {
+
+		p := DefaultRetryPolicy()
+
+		Convey("Then the attempts should be limited", func() {
+			So(p.MaxAttempts, ShouldBeGreaterThan, 0)
+			So(p.attemptsExhausted(p.MaxAttempts), ShouldBeTrue)
+		})
+	})
+}
+
+func TestRetryPolicy_parseRetryAfter(t *testing.T) {
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	Convey("Given I parse a Retry-After in seconds", t, func() {
+		d, ok := parseRetryAfter("3", now)
+		So(ok, ShouldBeTrue)
+		So(d, ShouldEqual, 3*time.Second)
+	})
+
+	Convey("Given I parse a Retry-After as a date", t, func() {
+		d, ok := parseRetryAfter(now.Add(10*time.Second).Format(http.TimeFormat), now)
+		So(ok, ShouldBeTrue)
+		So(d, ShouldEqual, 10*time.Second)
+	})
+
+	Convey("Given I parse a Retry-After as a date in the past", t, func() {
+		d, ok := parseRetryAfter(now.Add(-10*time.Second).Format(http.TimeFormat), now)
+		So(ok, ShouldBeTrue)
+		So(d, ShouldEqual, 0)
+	})
+
+	Convey("Given I parse an empty Retry-After", t, func() {
+		_, ok := parseRetryAfter("", now)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given I parse an invalid Retry-After", t, func() {
+		_, ok := parseRetryAfter("nope", now)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given I parse a negative Retry-After", t, func() {
+		_, ok := parseRetryAfter("-1", now)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestRetryPolicy_classifyError(t *testing.T) {
+
+	Convey("Given I have various errors", t, func() {
+
+		So(classifyError(&url.Error{Err: x509.UnknownAuthorityError{}}), ShouldEqual, 0)
+		So(classifyError(&url.Error{Err: x509.HostnameError{}}), ShouldEqual, 0)
+		So(classifyError(&url.Error{Err: io.EOF}), ShouldEqual, ErrorClassEOF)
+		So(classifyError(&url.Error{Err: &net.OpError{Op: "dial", Err: errors.New("refused")}}), ShouldEqual, ErrorClassNetwork)
+		So(classifyError(&url.Error{Err: &net.DNSError{Err: "no such host"}}), ShouldEqual, ErrorClassNetwork)
+		So(classifyError(&url.Error{Err: &net.DNSError{Err: "timeout", IsTimeout: true}}), ShouldEqual, ErrorClassTimeout)
+		So(classifyError(errors.New("boom")), ShouldEqual, ErrorClassOther)
+	})
+}
+
+func TestClient_sendRetry(t *testing.T) {
+
+	policy := RetryPolicy{
+		InitialBackoff:       time.Millisecond,
+		Multiplier:           1,
+		RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+		RetryableErrors:      ErrorClassAll,
+	}
+
+	Convey("Given I have a client and a server that is unavailable a few times", t, func() {
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&called, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, `{"token": "yeay!"}`)
+		}))
+		defer ts.Close()
+
+		cl := NewClientWithRetryPolicy(ts.URL, &tls.Config{}, policy)
+
+		Convey("When I call sendRequest", func() {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+
+			jwt, err := cl.sendRequest(ctx, &gaia.Issue{Realm: "test"})
+
+			Convey("Then err should be nil", func() {
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Then jwt be correct", func() {
+				So(jwt, ShouldEqual, "yeay!")
+			})
+
+			Convey("Then the server should have been called 3 times", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 3)
+			})
+		})
+	})
+
+	Convey("Given I have a client with max attempts and a server that is always unavailable", t, func() {
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, `[{"code": 503, "title": "Service Unavailable", "description": "nope", "subject": "midgard"}]`)
+		}))
+		defer ts.Close()
+
+		p := policy
+		p.MaxAttempts = 2
+		cl := NewClientWithRetryPolicy(ts.URL, &tls.Config{}, p)
+
+		Convey("When I call sendRequest", func() {
+
+			jwt, err := cl.sendRequest(context.Background(), &gaia.Issue{Realm: "test"})
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "error 503 (midgard): Service Unavailable: nope")
+			})
+
+			Convey("Then jwt be empty", func() {
+				So(jwt, ShouldBeEmpty)
+			})
+
+			Convey("Then the server should have been called 2 times", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Given I have a client and a server that asks to retry later", t, func() {
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ts.Close()
+
+		p := policy
+		p.HonorRetryAfter = true
+		cl := NewClientWithRetryPolicy(ts.URL, &tls.Config{}, p)
+
+		Convey("When I call sendRequest with a short deadline", func() {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+
+			_, err := cl.sendRequest(ctx, &gaia.Issue{Realm: "test"})
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			})
+
+			Convey("Then the server should have been called once", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("Given I have a client with max attempts and an unreachable server", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		u := ts.URL
+		ts.Close()
+
+		p := policy
+		p.MaxAttempts = 3
+		cl := NewClientWithRetryPolicy(u, &tls.Config{}, p)
+
+		Convey("When I call sendRequest without deadline", func() {
+
+			_, err := cl.sendRequest(context.Background(), &gaia.Issue{Realm: "test"})
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
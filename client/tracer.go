@@ -0,0 +1,116 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"net/http"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+var defaultTracer = NewOpenTracingTracer()
+
+// A Tracer creates the spans of the operations of a Client and
+// propagates their context in the requests sent to midgard. It is
+// also used by the middleware to trace the requests it receives.
+type Tracer interface {
+
+	// StartSpan starts a span with the given name, child of the span
+	// in the given context, and returns a context holding it.
+	StartSpan(ctx context.Context, name string) (Span, context.Context)
+
+	// StartServerSpan starts a span with the given name for a request
+	// received with the given header, continuing the span whose context
+	// is propagated in the header, if any, and returns a context holding
+	// it.
+	StartServerSpan(ctx context.Context, name string, header http.Header) (Span, context.Context)
+
+	// Inject injects the context of the span in
+	// the given context into the given header.
+	Inject(ctx context.Context, header http.Header) error
+}
+
+// A Span is a span started by a Tracer.
+type Span interface {
+
+	// SetTag sets the given tag on the span.
+	SetTag(key string, value interface{})
+
+	// SetError marks the span as failed with the given error.
+	SetError(err error)
+
+	// Finish finishes the span.
+	Finish()
+}
+
+// NewOpenTracingTracer returns a Tracer using the opentracing global
+// tracer. This is the Tracer used by a Client when none is set.
+func NewOpenTracingTracer() Tracer {
+
+	return openTracingTracer{}
+}
+
+type openTracingTracer struct{}
+
+func (openTracingTracer) StartSpan(ctx context.Context, name string) (Span, context.Context) {
+
+	span, subctx := opentracing.StartSpanFromContext(ctx, name)
+
+	return openTracingSpan{span: span}, subctx
+}
+
+func (openTracingTracer) StartServerSpan(ctx context.Context, name string, header http.Header) (Span, context.Context) {
+
+	tracer := opentracing.GlobalTracer()
+
+	var options []opentracing.StartSpanOption
+	if wireContext, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)); err == nil {
+		options = append(options, ext.RPCServerOption(wireContext))
+	}
+
+	span := tracer.StartSpan(name, options...)
+
+	return openTracingSpan{span: span}, opentracing.ContextWithSpan(ctx, span)
+}
+
+func (openTracingTracer) Inject(ctx context.Context, header http.Header) error {
+
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return nil
+	}
+
+	return span.Tracer().Inject(span.Context(), opentracing.TextMap, opentracing.HTTPHeadersCarrier(header))
+}
+
+type openTracingSpan struct {
+	span opentracing.Span
+}
+
+func (s openTracingSpan) SetTag(key string, value interface{}) {
+
+	s.span.SetTag(key, value)
+}
+
+func (s openTracingSpan) SetError(err error) {
+
+	s.span.SetTag("error", true)
+	s.span.LogFields(log.Error(err))
+}
+
+func (s openTracingSpan) Finish() {
+
+	s.span.Finish()
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia"
+)
+
+func TestTracer_OpenTracing(t *testing.T) {
+
+	Convey("Given I have a client using the default tracer", t, func() {
+
+		var header http.Header
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header
+			issue := gaia.NewIssue()
+			_ = json.NewDecoder(r.Body).Decode(issue)
+			issue.Token = "token"
+			_ = json.NewEncoder(w).Encode(issue)
+		}))
+		defer ts.Close()
+
+		tracer := mocktracer.New()
+		opentracing.SetGlobalTracer(tracer)
+		defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+		cl := NewClient(ts.URL)
+
+		Convey("When I issue a token", func() {
+
+			_, err := cl.IssueFromCertificate(context.Background(), time.Minute)
+			So(err, ShouldBeNil)
+
+			spans := tracer.FinishedSpans()
+
+			Convey("Then the opentracing spans should have been recorded", func() {
+				So(len(spans), ShouldEqual, 2)
+				So(spans[0].OperationName, ShouldEqual, "midgardlib.client.send")
+				So(spans[0].Tag("attempt"), ShouldEqual, 1)
+				So(spans[0].Tag("http.status_code"), ShouldEqual, http.StatusOK)
+				So(spans[1].OperationName, ShouldEqual, "midgardlib.client.issue.certificate")
+				So(spans[1].Tag("realm"), ShouldEqual, string(gaia.IssueRealmCertificate))
+			})
+
+			Convey("Then the span context should have been injected", func() {
+				So(header.Get("Mockpfx-Ids-Spanid"), ShouldNotBeEmpty)
+			})
+		})
+	})
+}
@@ -12,7 +12,10 @@
 package midgardclient
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -21,6 +24,7 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"go.aporeto.io/gaia"
@@ -47,24 +51,53 @@ func ParseCredentials(data []byte) (creds *gaia.Credential, tlsConfig *tls.Confi
 // CredsToTLSConfig converts Crendential to *tlsConfig
 func CredsToTLSConfig(creds *gaia.Credential) (tlsConfig *tls.Config, err error) {
 
-	caData, err := base64.StdEncoding.DecodeString(creds.CertificateAuthority)
+	caData, certData, keyData, err := credsToPEM(creds)
 	if err != nil {
-		return nil, fmt.Errorf("unable to decode ca: %s", err)
+		return nil, err
+	}
+
+	clientCert, capool, err := pemToTLSMaterial(caData, certData, keyData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		RootCAs:      capool,
+		Certificates: []tls.Certificate{clientCert},
+	}, nil
+
+}
+
+// credsToPEM decodes the PEM encoded ca,
+// certificate and key of the given Credential.
+func credsToPEM(creds *gaia.Credential) (caData []byte, certData []byte, keyData []byte, err error) {
+
+	caData, err = base64.StdEncoding.DecodeString(creds.CertificateAuthority)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to decode ca: %s", err)
 	}
 
-	certData, err := base64.StdEncoding.DecodeString(creds.Certificate)
+	certData, err = base64.StdEncoding.DecodeString(creds.Certificate)
 	if err != nil {
-		return nil, fmt.Errorf("unable to decode certificate: %s", err)
+		return nil, nil, nil, fmt.Errorf("unable to decode certificate: %s", err)
 	}
 
-	keyData, err := base64.StdEncoding.DecodeString(creds.CertificateKey)
+	keyData, err = base64.StdEncoding.DecodeString(creds.CertificateKey)
 	if err != nil {
-		return nil, fmt.Errorf("unable to decode key: %s", err)
+		return nil, nil, nil, fmt.Errorf("unable to decode key: %s", err)
 	}
 
+	return caData, certData, keyData, nil
+}
+
+// pemToTLSMaterial returns the tls.Certificate from the given PEM
+// encoded certificate and key, and the system cert pool with the
+// given PEM encoded ca added.
+func pemToTLSMaterial(caData []byte, certData []byte, keyData []byte) (tls.Certificate, *x509.CertPool, error) {
+
 	capool, err := tglib.SystemCertPool()
 	if err != nil {
-		return nil, fmt.Errorf("unable to read system cert pool: %s", err)
+		return tls.Certificate{}, nil, fmt.Errorf("unable to read system cert pool: %s", err)
 	}
 
 	// Here we cannot differentiate from:
@@ -75,37 +108,28 @@ func CredsToTLSConfig(creds *gaia.Credential) (tlsConfig *tls.Config, err error)
 
 	cert, key, err := tglib.ReadCertificate(certData, keyData, "")
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse certificate: %s", err)
+		return tls.Certificate{}, nil, fmt.Errorf("unable to parse certificate: %s", err)
 	}
 
 	clientCert, err := tglib.ToTLSCertificate(cert, key)
 	if err != nil {
-		return nil, fmt.Errorf("unable to convert certificate: %s", err)
+		return tls.Certificate{}, nil, fmt.Errorf("unable to convert certificate: %s", err)
 	}
 
-	return &tls.Config{
-		RootCAs:      capool,
-		Certificates: []tls.Certificate{clientCert},
-	}, nil
-
+	return clientCert, capool, nil
 }
 
 // ExtractJWTFromHeader extracts the JWT from the given http.Header.
+// The Bearer scheme is case insensitive and extra whitespace is ignored.
 func ExtractJWTFromHeader(header http.Header) (string, error) {
 
 	auth := header.Get("Authorization")
 
-	if auth == "" {
+	if strings.TrimSpace(auth) == "" {
 		return "", fmt.Errorf("missing authorization header")
 	}
 
-	parts := strings.Split(auth, " ")
-
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return "", fmt.Errorf("invalid authorization header")
-	}
-
-	return parts[1], nil
+	return ParseAuthorization(auth)
 }
 
 // VerifyTokenSignature verifies the jwt locally using the given certificate.
@@ -122,28 +146,110 @@ func VerifyTokenSignature(tokenString string, cert *x509.Certificate) ([]string,
 	return NormalizeAuth(c), nil
 }
 
+// A SigningMethodError is returned when the signing method
+// of a token does not match the type of the verification key.
+type SigningMethodError struct {
+	Algorithm string
+	KeyType   string
+}
+
+func (e *SigningMethodError) Error() string {
+
+	return fmt.Sprintf("unexpected signing method '%s' for %s key", e.Algorithm, e.KeyType)
+}
+
+// An UnsupportedKeyError is returned when the
+// verification key type is not supported.
+type UnsupportedKeyError struct {
+	KeyType string
+}
+
+func (e *UnsupportedKeyError) Error() string {
+
+	return fmt.Sprintf("unsupported verification key type %s", e.KeyType)
+}
+
 // VerifyToken verifies the jwt locally using the given certificate.
+// ECDSA, RSA, RSA-PSS and Ed25519 keys are supported. The signing
+// method announced by the token must match the type of the key.
 func VerifyToken(tokenString string, cert *x509.Certificate) (*types.MidgardClaims, error) {
 
-	c := &types.MidgardClaims{}
+	return VerifyTokenWithOptions(tokenString, cert)
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, c, func(token *jwt.Token) (interface{}, error) {
+// VerifyTokenWithOptions verifies the jwt locally using the given certificate
+// like VerifyToken, then validates its claims according to the given options.
+func VerifyTokenWithOptions(tokenString string, cert *x509.Certificate, options ...VerifyOption) (*types.MidgardClaims, error) {
 
-		_, ok := token.Method.(*jwt.SigningMethodECDSA)
-		if !ok {
-			return nil, fmt.Errorf("unexpected signing method: %s", token.Header["alg"])
-		}
+	if cert == nil {
+		return nil, fmt.Errorf("missing verification certificate")
+	}
+
+	opts := verifyOpts{
+		now: time.Now,
+	}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	c := &types.MidgardClaims{}
+	p := jwt.Parser{SkipClaimsValidation: true}
 
-		return cert.PublicKey.(*ecdsa.PublicKey), nil
+	token, err := p.ParseWithClaims(tokenString, c, func(token *jwt.Token) (interface{}, error) {
+		return verificationKey(token, cert.PublicKey)
 	})
 
 	if err != nil {
+		// jwt-go does not allow to unwrap errors
+		// returned by the key func.
+		if verr, ok := err.(*jwt.ValidationError); ok {
+			switch inner := verr.Inner.(type) {
+			case *SigningMethodError, *UnsupportedKeyError:
+				return nil, inner
+			}
+		}
+		return nil, err
+	}
+
+	if err := validateClaims(c, opts); err != nil {
 		return nil, err
 	}
 
 	return token.Claims.(*types.MidgardClaims), nil
 }
 
+// verificationKey returns the given public key if it can
+// be used to verify the signing method of the given token.
+func verificationKey(token *jwt.Token, publicKey crypto.PublicKey) (interface{}, error) {
+
+	alg, _ := token.Header["alg"].(string)
+
+	switch key := publicKey.(type) {
+
+	case *ecdsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+			return nil, &SigningMethodError{Algorithm: alg, KeyType: "ECDSA"}
+		}
+		return key, nil
+
+	case *rsa.PublicKey:
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return key, nil
+		}
+		return nil, &SigningMethodError{Algorithm: alg, KeyType: "RSA"}
+
+	case ed25519.PublicKey:
+		if token.Method != SigningMethodEdDSA {
+			return nil, &SigningMethodError{Algorithm: alg, KeyType: "Ed25519"}
+		}
+		return key, nil
+
+	default:
+		return nil, &UnsupportedKeyError{KeyType: fmt.Sprintf("%T", publicKey)}
+	}
+}
+
 // UnsecureClaimsFromToken gets a token and returns the Aporeto
 // claims contained inside. It is Unsecure in the sense that
 // It doesn't verify the token signature, so the token must be
@@ -13,11 +13,20 @@ package midgardclient
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"math/big"
 	"net/http"
 	"reflect"
 	"testing"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	. "github.com/smartystreets/goconvey/convey"
@@ -500,3 +509,145 @@ func TestVerifyTokenSignature(t *testing.T) {
 		})
 	})
 }
+
+func selfSignedCert(publicKey crypto.PublicKey, privateKey crypto.PrivateKey) *x509.Certificate {
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	data, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, privateKey)
+	if err != nil {
+		panic(err)
+	}
+
+	c, err := x509.ParseCertificate(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+func TestVerifyToken_KeyTypes(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	rsaCert := selfSignedCert(rsaKey.Public(), rsaKey)
+
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	edCert := selfSignedCert(edPublicKey, edKey)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	Convey("Given I verify a valid RSA token", t, func() {
+
+		token := makeToken(&jwt.StandardClaims{Subject: "sub"}, jwt.SigningMethodRS256, rsaKey)
+
+		claims, err := VerifyToken(token, rsaCert)
+
+		So(err, ShouldBeNil)
+		So(claims.Subject, ShouldEqual, "sub")
+	})
+
+	Convey("Given I verify a valid RSA-PSS token", t, func() {
+
+		token := makeToken(&jwt.StandardClaims{Subject: "sub"}, jwt.SigningMethodPS256, rsaKey)
+
+		claims, err := VerifyToken(token, rsaCert)
+
+		So(err, ShouldBeNil)
+		So(claims.Subject, ShouldEqual, "sub")
+	})
+
+	Convey("Given I verify a valid EdDSA token", t, func() {
+
+		token := makeToken(&jwt.StandardClaims{Subject: "sub"}, SigningMethodEdDSA, edKey)
+
+		claims, err := VerifyToken(token, edCert)
+
+		So(err, ShouldBeNil)
+		So(claims.Subject, ShouldEqual, "sub")
+	})
+
+	Convey("Given I verify an EdDSA token with the wrong key", t, func() {
+
+		_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+		token := makeToken(&jwt.StandardClaims{Subject: "sub"}, SigningMethodEdDSA, otherKey)
+
+		claims, err := VerifyToken(token, edCert)
+
+		So(err, ShouldNotBeNil)
+		So(claims, ShouldBeNil)
+	})
+
+	Convey("Given I verify an ECDSA token with an RSA certificate", t, func() {
+
+		token := makeToken(&jwt.StandardClaims{Subject: "sub"}, jwt.SigningMethodES256, ecKey)
+
+		claims, err := VerifyToken(token, rsaCert)
+
+		So(claims, ShouldBeNil)
+
+		var serr *SigningMethodError
+		So(errors.As(err, &serr), ShouldBeTrue)
+		So(serr.Algorithm, ShouldEqual, "ES256")
+		So(serr.KeyType, ShouldEqual, "RSA")
+		So(err.Error(), ShouldEqual, "unexpected signing method 'ES256' for RSA key")
+	})
+
+	Convey("Given I verify an RSA token with an ECDSA certificate", t, func() {
+
+		token := makeToken(&jwt.StandardClaims{Subject: "sub"}, jwt.SigningMethodRS256, rsaKey)
+
+		_, err := VerifyToken(token, cert(signerCert))
+
+		var serr *SigningMethodError
+		So(errors.As(err, &serr), ShouldBeTrue)
+		So(serr.KeyType, ShouldEqual, "ECDSA")
+	})
+
+	Convey("Given I verify an HMAC token with an Ed25519 certificate", t, func() {
+
+		token := makeToken(&jwt.StandardClaims{Subject: "sub"}, jwt.SigningMethodHS256, []byte("secret"))
+
+		_, err := VerifyToken(token, edCert)
+
+		var serr *SigningMethodError
+		So(errors.As(err, &serr), ShouldBeTrue)
+		So(serr.Algorithm, ShouldEqual, "HS256")
+		So(serr.KeyType, ShouldEqual, "Ed25519")
+	})
+
+	Convey("Given I verify a token with a certificate with an unsupported key", t, func() {
+
+		token := makeToken(&jwt.StandardClaims{Subject: "sub"}, jwt.SigningMethodES256, ecKey)
+
+		_, err := VerifyToken(token, &x509.Certificate{PublicKey: "nope"})
+
+		var uerr *UnsupportedKeyError
+		So(errors.As(err, &uerr), ShouldBeTrue)
+		So(err.Error(), ShouldEqual, "unsupported verification key type string")
+	})
+
+	Convey("Given I verify a token without certificate", t, func() {
+
+		token := makeToken(&jwt.StandardClaims{Subject: "sub"}, jwt.SigningMethodES256, ecKey)
+
+		_, err := VerifyToken(token, nil)
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "missing verification certificate")
+	})
+}
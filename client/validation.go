@@ -0,0 +1,264 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.aporeto.io/gaia/types"
+)
+
+type verifyOpts struct {
+	issuer            string
+	audience          string
+	realms            []string
+	maxAge            time.Duration
+	clockSkew         time.Duration
+	namespacePrefixes []string
+	now               func() time.Time
+}
+
+// A VerifyOption is the type of various options
+// you can pass to VerifyTokenWithOptions.
+type VerifyOption func(*verifyOpts)
+
+// OptVerifyIssuer requires the token to be issued by the given issuer.
+func OptVerifyIssuer(issuer string) VerifyOption {
+
+	return func(opts *verifyOpts) {
+		opts.issuer = issuer
+	}
+}
+
+// OptVerifyAudience requires the token to have been issued
+// for the given audience, as requested with OptAudience.
+func OptVerifyAudience(audience string) VerifyOption {
+
+	return func(opts *verifyOpts) {
+		opts.audience = audience
+	}
+}
+
+// OptVerifyRealms requires the token to have been
+// issued from one of the given realms.
+func OptVerifyRealms(realms ...string) VerifyOption {
+
+	return func(opts *verifyOpts) {
+		opts.realms = realms
+	}
+}
+
+// OptVerifyMaxAge requires the token to have been
+// issued less than the given duration ago.
+func OptVerifyMaxAge(maxAge time.Duration) VerifyOption {
+
+	return func(opts *verifyOpts) {
+		opts.maxAge = maxAge
+	}
+}
+
+// OptVerifyClockSkew sets the tolerance applied when
+// checking the expiration, not before and issued at times.
+func OptVerifyClockSkew(skew time.Duration) VerifyOption {
+
+	return func(opts *verifyOpts) {
+		opts.clockSkew = skew
+	}
+}
+
+// OptVerifyRestrictedNamespace requires the token to be restricted
+// to one of the given namespaces, or to one of their children.
+func OptVerifyRestrictedNamespace(prefixes ...string) VerifyOption {
+
+	return func(opts *verifyOpts) {
+		opts.namespacePrefixes = prefixes
+	}
+}
+
+// An ExpiredError is returned when the token is expired.
+type ExpiredError struct {
+	ExpiresAt time.Time
+}
+
+func (e *ExpiredError) Error() string {
+
+	return fmt.Sprintf("token expired at %s", e.ExpiresAt.Format(time.RFC3339))
+}
+
+// A NotValidYetError is returned when the token
+// is used before its not before or issued at time.
+type NotValidYetError struct {
+	ValidFrom time.Time
+}
+
+func (e *NotValidYetError) Error() string {
+
+	return fmt.Sprintf("token is not valid before %s", e.ValidFrom.Format(time.RFC3339))
+}
+
+// An IssuerError is returned when the token
+// was not issued by the expected issuer.
+type IssuerError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *IssuerError) Error() string {
+
+	return fmt.Sprintf("invalid token issuer '%s': expected '%s'", e.Actual, e.Expected)
+}
+
+// An AudienceError is returned when the token
+// was not issued for the expected audience.
+type AudienceError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *AudienceError) Error() string {
+
+	return fmt.Sprintf("invalid token audience '%s': expected '%s'", e.Actual, e.Expected)
+}
+
+// A RealmError is returned when the token was
+// not issued from one of the allowed realms.
+type RealmError struct {
+	Allowed []string
+	Actual  string
+}
+
+func (e *RealmError) Error() string {
+
+	return fmt.Sprintf("invalid token realm '%s': expected one of '%s'", e.Actual, strings.Join(e.Allowed, "', '"))
+}
+
+// A MaxAgeError is returned when the token
+// was issued too long ago.
+type MaxAgeError struct {
+	MaxAge   time.Duration
+	IssuedAt time.Time
+}
+
+func (e *MaxAgeError) Error() string {
+
+	if e.IssuedAt.IsZero() {
+		return "token age cannot be verified: missing issued at time"
+	}
+
+	return fmt.Sprintf("token issued at %s is older than %s", e.IssuedAt.Format(time.RFC3339), e.MaxAge)
+}
+
+// A RestrictedNamespaceError is returned when the token is not
+// restricted to one of the required namespaces.
+type RestrictedNamespaceError struct {
+	Required []string
+	Actual   string
+}
+
+func (e *RestrictedNamespaceError) Error() string {
+
+	if e.Actual == "" {
+		return fmt.Sprintf("token is not restricted to a namespace: expected one of '%s'", strings.Join(e.Required, "', '"))
+	}
+
+	return fmt.Sprintf("invalid token restricted namespace '%s': expected one of '%s'", e.Actual, strings.Join(e.Required, "', '"))
+}
+
+// validateClaims validates the given claims according to the given options.
+func validateClaims(c *types.MidgardClaims, opts verifyOpts) error {
+
+	now := opts.now()
+
+	if c.ExpiresAt != 0 {
+		if exp := time.Unix(c.ExpiresAt, 0); !now.Before(exp.Add(opts.clockSkew)) {
+			return &ExpiredError{ExpiresAt: exp}
+		}
+	}
+
+	if c.NotBefore != 0 {
+		if nbf := time.Unix(c.NotBefore, 0); now.Add(opts.clockSkew).Before(nbf) {
+			return &NotValidYetError{ValidFrom: nbf}
+		}
+	}
+
+	if c.IssuedAt != 0 {
+		if iat := time.Unix(c.IssuedAt, 0); now.Add(opts.clockSkew).Before(iat) {
+			return &NotValidYetError{ValidFrom: iat}
+		}
+	}
+
+	if opts.issuer != "" && c.Issuer != opts.issuer {
+		return &IssuerError{Expected: opts.issuer, Actual: c.Issuer}
+	}
+
+	if opts.audience != "" && c.Audience != opts.audience {
+		return &AudienceError{Expected: opts.audience, Actual: c.Audience}
+	}
+
+	if len(opts.realms) > 0 && !matchRealm(c.Realm, opts.realms) {
+		return &RealmError{Allowed: opts.realms, Actual: c.Realm}
+	}
+
+	if opts.maxAge > 0 {
+		if c.IssuedAt == 0 {
+			return &MaxAgeError{MaxAge: opts.maxAge}
+		}
+		if iat := time.Unix(c.IssuedAt, 0); now.Sub(iat) > opts.maxAge+opts.clockSkew {
+			return &MaxAgeError{MaxAge: opts.maxAge, IssuedAt: iat}
+		}
+	}
+
+	if len(opts.namespacePrefixes) > 0 {
+
+		r := RestrictionsFromMidgardClaims(c)
+		if !matchNamespacePrefix(r.Namespace, opts.namespacePrefixes) {
+			return &RestrictedNamespaceError{Required: opts.namespacePrefixes, Actual: r.Namespace}
+		}
+	}
+
+	return nil
+}
+
+func matchRealm(realm string, realms []string) bool {
+
+	for _, r := range realms {
+		if strings.EqualFold(r, realm) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchNamespacePrefix returns true if the given namespace is
+// one of the given namespaces or one of their children.
+func matchNamespacePrefix(namespace string, prefixes []string) bool {
+
+	if namespace == "" {
+		return false
+	}
+
+	for _, p := range prefixes {
+
+		if namespace == p || p == "/" {
+			return true
+		}
+
+		if strings.HasPrefix(namespace, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVerifyTokenWithOptions(t *testing.T) {
+
+	now := time.Now()
+
+	makeClaimsToken := func(claims jwt.MapClaims) string {
+		return makeToken(claims, jwt.SigningMethodES256, key(signerKey))
+	}
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":   "sub",
+			"iss":   "midgard.aporeto.com",
+			"aud":   "aporeto.com",
+			"realm": "certificate",
+			"iat":   now.Add(-time.Minute).Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+			"restrictions": map[string]interface{}{
+				"namespace": "/acme/prod",
+			},
+		}
+	}
+
+	Convey("Given I verify a valid token with all options", t, func() {
+
+		claims, err := VerifyTokenWithOptions(
+			makeClaimsToken(validClaims()),
+			cert(signerCert),
+			OptVerifyIssuer("midgard.aporeto.com"),
+			OptVerifyAudience("aporeto.com"),
+			OptVerifyRealms("Vince", "Certificate"),
+			OptVerifyMaxAge(time.Hour),
+			OptVerifyClockSkew(time.Second),
+			OptVerifyRestrictedNamespace("/other", "/acme"),
+		)
+
+		So(err, ShouldBeNil)
+		So(claims.Subject, ShouldEqual, "sub")
+	})
+
+	Convey("Given I verify an expired token", t, func() {
+
+		c := validClaims()
+		c["exp"] = now.Add(-time.Minute).Unix()
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(c), cert(signerCert))
+
+		var e *ExpiredError
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(e.ExpiresAt.Unix(), ShouldEqual, c["exp"])
+	})
+
+	Convey("Given I verify a recently expired token with clock skew", t, func() {
+
+		c := validClaims()
+		c["exp"] = now.Add(-time.Second).Unix()
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(c), cert(signerCert), OptVerifyClockSkew(time.Minute))
+
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Given I verify a token that is not valid yet", t, func() {
+
+		c := validClaims()
+		c["nbf"] = now.Add(time.Hour).Unix()
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(c), cert(signerCert))
+
+		var e *NotValidYetError
+		So(errors.As(err, &e), ShouldBeTrue)
+	})
+
+	Convey("Given I verify a token issued slightly in the future with clock skew", t, func() {
+
+		c := validClaims()
+		c["iat"] = now.Add(2 * time.Second).Unix()
+
+		_, err1 := VerifyTokenWithOptions(makeClaimsToken(c), cert(signerCert))
+		_, err2 := VerifyTokenWithOptions(makeClaimsToken(c), cert(signerCert), OptVerifyClockSkew(time.Minute))
+
+		var e *NotValidYetError
+		So(errors.As(err1, &e), ShouldBeTrue)
+		So(err2, ShouldBeNil)
+	})
+
+	Convey("Given I verify a token with the wrong issuer", t, func() {
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(validClaims()), cert(signerCert), OptVerifyIssuer("nope"))
+
+		var e *IssuerError
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(err.Error(), ShouldEqual, "invalid token issuer 'midgard.aporeto.com': expected 'nope'")
+	})
+
+	Convey("Given I verify a token with the wrong audience", t, func() {
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(validClaims()), cert(signerCert), OptVerifyAudience("nope"))
+
+		var e *AudienceError
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(err.Error(), ShouldEqual, "invalid token audience 'aporeto.com': expected 'nope'")
+	})
+
+	Convey("Given I verify a token with the wrong realm", t, func() {
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(validClaims()), cert(signerCert), OptVerifyRealms("Vince", "LDAP"))
+
+		var e *RealmError
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(err.Error(), ShouldEqual, "invalid token realm 'certificate': expected one of 'Vince', 'LDAP'")
+	})
+
+	Convey("Given I verify a token that is too old", t, func() {
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(validClaims()), cert(signerCert), OptVerifyMaxAge(time.Second))
+
+		var e *MaxAgeError
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(e.MaxAge, ShouldEqual, time.Second)
+	})
+
+	Convey("Given I verify a token without issued at time and a max age", t, func() {
+
+		c := validClaims()
+		delete(c, "iat")
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(c), cert(signerCert), OptVerifyMaxAge(time.Hour))
+
+		var e *MaxAgeError
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(err.Error(), ShouldEqual, "token age cannot be verified: missing issued at time")
+	})
+
+	Convey("Given I verify a token restricted to the wrong namespace", t, func() {
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(validClaims()), cert(signerCert), OptVerifyRestrictedNamespace("/acme/prod2", "/other"))
+
+		var e *RestrictedNamespaceError
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(e.Actual, ShouldEqual, "/acme/prod")
+		So(err.Error(), ShouldEqual, "invalid token restricted namespace '/acme/prod': expected one of '/acme/prod2', '/other'")
+	})
+
+	Convey("Given I verify a token without restrictions and a required namespace", t, func() {
+
+		c := validClaims()
+		delete(c, "restrictions")
+
+		_, err := VerifyTokenWithOptions(makeClaimsToken(c), cert(signerCert), OptVerifyRestrictedNamespace("/"))
+
+		var e *RestrictedNamespaceError
+		So(errors.As(err, &e), ShouldBeTrue)
+		So(err.Error(), ShouldEqual, "token is not restricted to a namespace: expected one of '/'")
+	})
+}
+
+func TestValidation_matchNamespacePrefix(t *testing.T) {
+
+	Convey("Given I have some namespaces", t, func() {
+		So(matchNamespacePrefix("/a/b", []string{"/a"}), ShouldBeTrue)
+		So(matchNamespacePrefix("/a/b", []string{"/a/"}), ShouldBeTrue)
+		So(matchNamespacePrefix("/a/b", []string{"/a/b"}), ShouldBeTrue)
+		So(matchNamespacePrefix("/a/b", []string{"/"}), ShouldBeTrue)
+		So(matchNamespacePrefix("/ab", []string{"/a"}), ShouldBeFalse)
+		So(matchNamespacePrefix("/a", []string{"/a/b"}), ShouldBeFalse)
+		So(matchNamespacePrefix("", []string{"/"}), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,345 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.aporeto.io/gaia/types"
+	"go.uber.org/zap"
+)
+
+type verifierOpts struct {
+	certificatesPath   string
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+}
+
+// A VerifierOption is the type of various options
+// you can pass to NewVerifier.
+type VerifierOption func(*verifierOpts)
+
+// OptVerifierCertificatesPath sets the path of the midgard API
+// that serves the PEM encoded certificates used to sign tokens.
+func OptVerifierCertificatesPath(path string) VerifierOption {
+
+	return func(opts *verifierOpts) {
+		opts.certificatesPath = path
+	}
+}
+
+// OptVerifierRefreshInterval sets the interval at which
+// the signing certificates are refreshed by Run.
+func OptVerifierRefreshInterval(interval time.Duration) VerifierOption {
+
+	return func(opts *verifierOpts) {
+		opts.refreshInterval = interval
+	}
+}
+
+// OptVerifierMinRefreshInterval sets the minimum delay between two
+// refreshes triggered by tokens signed with an unknown key id.
+func OptVerifierMinRefreshInterval(interval time.Duration) VerifierOption {
+
+	return func(opts *verifierOpts) {
+		opts.minRefreshInterval = interval
+	}
+}
+
+// A Verifier verifies midgard tokens locally, using the signing
+// certificates it fetches from midgard. The certificates are fetched on
+// first use, periodically if Run is started and whenever a token signed
+// with an unknown key id is verified.
+type Verifier struct {
+	client *Client
+	opts   verifierOpts
+
+	certs       []*x509.Certificate
+	certsByKID  map[string]*x509.Certificate
+	lastRefresh time.Time
+	certsLock   sync.RWMutex
+
+	refreshLock sync.Mutex
+}
+
+// NewVerifier returns a new Verifier that uses the given
+// Client to retrieve the signing certificates.
+func NewVerifier(client *Client, options ...VerifierOption) *Verifier {
+
+	if client == nil {
+		panic("client cannot be nil")
+	}
+
+	opts := verifierOpts{
+		certificatesPath:   "/jwtcert",
+		refreshInterval:    1 * time.Hour,
+		minRefreshInterval: 30 * time.Second,
+	}
+
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	return &Verifier{
+		client: client,
+		opts:   opts,
+	}
+}
+
+// Verify verifies the given token, validates its claims according
+// to the given options and returns the claims it contains.
+func (v *Verifier) Verify(ctx context.Context, token string, options ...VerifyOption) (*types.MidgardClaims, error) {
+
+	kid, err := tokenKeyID(token)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := v.lookup(kid)
+	if len(certs) == 0 {
+
+		if err := v.refresh(ctx, true); err != nil {
+			return nil, &CertificatesFetchError{Err: err}
+		}
+
+		if certs = v.lookup(kid); len(certs) == 0 {
+			return nil, fmt.Errorf("unknown signing certificate for key id '%s'", kid)
+		}
+	}
+
+	for _, cert := range certs {
+		var claims *types.MidgardClaims
+		if claims, err = VerifyTokenWithOptions(token, cert, options...); err == nil {
+			return claims, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Certificates returns the signing certificates currently known.
+func (v *Verifier) Certificates() []*x509.Certificate {
+
+	v.certsLock.RLock()
+	defer v.certsLock.RUnlock()
+
+	return append([]*x509.Certificate(nil), v.certs...)
+}
+
+// Refresh fetches the signing certificates from midgard.
+func (v *Verifier) Refresh(ctx context.Context) error {
+
+	return v.refresh(ctx, false)
+}
+
+// Run refreshes the signing certificates periodically
+// until the given context is done.
+func (v *Verifier) Run(ctx context.Context) {
+
+	for {
+
+		select {
+
+		case <-time.After(v.opts.refreshInterval):
+
+			subctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			err := v.Refresh(subctx)
+			cancel()
+
+			if err != nil {
+				v.client.log().Error("Unable to refresh midgard signing certificates", zap.Error(err))
+				break
+			}
+
+			v.client.log().Debug("Midgard signing certificates refreshed")
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lookup returns the certificates that can verify
+// a token signed with the given key id.
+func (v *Verifier) lookup(kid string) []*x509.Certificate {
+
+	v.certsLock.RLock()
+	defer v.certsLock.RUnlock()
+
+	if kid == "" {
+		return v.certs
+	}
+
+	if cert, ok := v.certsByKID[kid]; ok {
+		return []*x509.Certificate{cert}
+	}
+
+	return nil
+}
+
+// A CertificatesFetchError is returned by Verify when the signing
+// certificates cannot be fetched from midgard.
+type CertificatesFetchError struct {
+	Err error
+}
+
+func (e *CertificatesFetchError) Error() string {
+
+	return fmt.Sprintf("unable to fetch signing certificates: %s", e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *CertificatesFetchError) Unwrap() error {
+
+	return e.Err
+}
+
+// refresh fetches the signing certificates. If onDemand is true,
+// it does nothing if the last refresh attempt is too recent.
+func (v *Verifier) refresh(ctx context.Context, onDemand bool) error {
+
+	v.refreshLock.Lock()
+	defer v.refreshLock.Unlock()
+
+	v.certsLock.Lock()
+	lastRefresh := v.lastRefresh
+	if onDemand && !lastRefresh.IsZero() && time.Since(lastRefresh) < v.opts.minRefreshInterval {
+		v.certsLock.Unlock()
+		return nil
+	}
+	// Failed attempts are recorded too, so tokens signed with an
+	// unknown key id cannot make us hammer midgard while it fails.
+	v.lastRefresh = time.Now()
+	v.certsLock.Unlock()
+
+	certs, err := v.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	certsByKID := make(map[string]*x509.Certificate, len(certs))
+	for _, cert := range certs {
+		for _, kid := range certificateKeyIDs(cert) {
+			certsByKID[kid] = cert
+		}
+	}
+
+	v.certsLock.Lock()
+	v.certs = certs
+	v.certsByKID = certsByKID
+	v.certsLock.Unlock()
+
+	return nil
+}
+
+// fetch retrieves the signing certificates from midgard.
+func (v *Verifier) fetch(ctx context.Context) ([]*x509.Certificate, error) {
+
+	span, subctx := v.client.tracer().StartSpan(ctx, "midgardlib.verifier.fetch")
+	defer span.Finish()
+
+	builder := func(baseURL string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, baseURL+v.opts.certificatesPath, nil)
+	}
+
+	resp, endpoint, err := v.client.sendRetry(subctx, builder)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRequestError(resp, endpoint)
+	}
+
+	defer resp.Body.Close() // nolint: errcheck
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signing certificates: %w", err)
+	}
+
+	return parseCertificates(data)
+}
+
+// parseCertificates parses the given PEM encoded certificates.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+
+	var certs []*x509.Certificate
+
+	for {
+
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse signing certificate: %w", err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no signing certificate returned")
+	}
+
+	return certs, nil
+}
+
+// certificateKeyIDs returns the key ids that can
+// designate the given certificate in a token header.
+func certificateKeyIDs(cert *x509.Certificate) []string {
+
+	var kids []string
+
+	if len(cert.SubjectKeyId) > 0 {
+		kids = append(kids, hex.EncodeToString(cert.SubjectKeyId))
+	}
+
+	if cert.SerialNumber != nil {
+		kids = append(kids, cert.SerialNumber.String(), cert.SerialNumber.Text(16))
+	}
+
+	return kids
+}
+
+// tokenKeyID returns the key id from the header of the given token.
+func tokenKeyID(token string) (string, error) {
+
+	p := jwt.Parser{}
+
+	t, _, err := p.ParseUnverified(token, &jwt.StandardClaims{})
+	if err != nil {
+		return "", err
+	}
+
+	kid, _ := t.Header["kid"].(string)
+
+	return strings.ToLower(kid), nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package midgardclient
+
+import (
+	"context"
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func makeTokenWithKID(claims jwt.Claims, kid string, key crypto.PrivateKey) string {
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	t, err := token.SignedString(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+func TestVerifier_Verify(t *testing.T) {
+
+	Convey("Given I create a verifier without client", t, func() {
+		So(func() { NewVerifier(nil) }, ShouldPanicWith, "client cannot be nil")
+	})
+
+	Convey("Given I have a verifier and a server serving the signing certificate", t, func() {
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			if r.URL.Path != "/jwtcert" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(signerCert)
+		}))
+		defer ts.Close()
+
+		v := NewVerifier(NewClient(ts.URL), OptVerifierMinRefreshInterval(time.Hour))
+
+		kid := cert(signerCert).SerialNumber.Text(16)
+
+		Convey("When I verify a valid token with a known kid twice", func() {
+
+			token := makeTokenWithKID(&jwt.StandardClaims{Subject: "sub"}, kid, key(signerKey))
+
+			claims1, err1 := v.Verify(context.Background(), token)
+			claims2, err2 := v.Verify(context.Background(), token)
+
+			Convey("Then err should be nil", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+			})
+
+			Convey("Then claims should be correct", func() {
+				So(claims1.Subject, ShouldEqual, "sub")
+				So(claims2.Subject, ShouldEqual, "sub")
+			})
+
+			Convey("Then the certificates should have been fetched once", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 1)
+				So(len(v.Certificates()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I verify a valid token without kid", func() {
+
+			token := makeTokenWithKID(&jwt.StandardClaims{Subject: "sub"}, "", key(signerKey))
+
+			claims, err := v.Verify(context.Background(), token)
+
+			Convey("Then err should be nil", func() {
+				So(err, ShouldBeNil)
+				So(claims.Subject, ShouldEqual, "sub")
+			})
+		})
+
+		Convey("When I verify a token signed by the wrong key", func() {
+
+			token := makeTokenWithKID(&jwt.StandardClaims{Subject: "sub"}, kid, key(wrongSignerKey))
+
+			claims, err := v.Verify(context.Background(), token)
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+				So(claims, ShouldBeNil)
+			})
+		})
+
+		Convey("When I verify tokens with an unknown kid", func() {
+
+			token := makeTokenWithKID(&jwt.StandardClaims{Subject: "sub"}, "unknown", key(signerKey))
+
+			_, err1 := v.Verify(context.Background(), token)
+			_, err2 := v.Verify(context.Background(), token)
+
+			Convey("Then err should not be nil", func() {
+				So(err1, ShouldNotBeNil)
+				So(err1.Error(), ShouldEqual, "unknown signing certificate for key id 'unknown'")
+				So(err2, ShouldNotBeNil)
+			})
+
+			Convey("Then the refresh should have been rate limited", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I verify an invalid token", func() {
+
+			_, err := v.Verify(context.Background(), "nope")
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Then the certificates should not have been fetched", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I run the verifier", func() {
+
+			v.opts.refreshInterval = time.Millisecond
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			go v.Run(ctx)
+
+			for atomic.LoadInt32(&called) < 2 {
+				select {
+				case <-ctx.Done():
+					panic("timeout exceeded")
+				case <-time.After(time.Millisecond):
+				}
+			}
+
+			Convey("Then the certificates should have been refreshed", func() {
+				So(len(v.Certificates()), ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("Given I have a verifier and a server that serves garbage", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("nope"))
+		}))
+		defer ts.Close()
+
+		v := NewVerifier(NewClient(ts.URL), OptVerifierCertificatesPath("/certs"), OptVerifierRefreshInterval(time.Minute))
+
+		Convey("When I refresh", func() {
+
+			err := v.Refresh(context.Background())
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "no signing certificate returned")
+			})
+		})
+	})
+
+	Convey("Given I have a verifier and a server that fails", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer ts.Close()
+
+		v := NewVerifier(NewClient(ts.URL))
+
+		Convey("When I refresh", func() {
+
+			err := v.Refresh(context.Background())
+
+			Convey("Then err should be a RequestError", func() {
+				So(err, ShouldNotBeNil)
+				So(IsUnauthorized(err), ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("Given I have a verifier and a server that keeps failing", t, func() {
+
+		var called int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer ts.Close()
+
+		v := NewVerifier(NewClient(ts.URL), OptVerifierMinRefreshInterval(time.Hour))
+
+		Convey("When I verify tokens with an unknown kid", func() {
+
+			token := makeTokenWithKID(&jwt.StandardClaims{Subject: "sub"}, "unknown", key(signerKey))
+
+			_, err1 := v.Verify(context.Background(), token)
+			_, err2 := v.Verify(context.Background(), token)
+
+			Convey("Then err should not be nil", func() {
+				So(IsUnauthorized(err1), ShouldBeTrue)
+				So(err2, ShouldNotBeNil)
+				So(err2.Error(), ShouldEqual, "unknown signing certificate for key id 'unknown'")
+			})
+
+			Convey("Then the failed refresh should have been rate limited", func() {
+				So(atomic.LoadInt32(&called), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I verify a token with an unknown kid and refresh", func() {
+
+			token := makeTokenWithKID(&jwt.StandardClaims{Subject: "sub"}, "unknown", key(signerKey))
+
+			_, _ = v.Verify(context.Background(), token)
+			err := v.Refresh(context.Background())
+
+			Convey("Then the explicit refresh should not have been rate limited", func() {
+				So(err, ShouldNotBeNil)
+				So(atomic.LoadInt32(&called), ShouldEqual, 2)
+			})
+		})
+	})
+}
@@ -14,4 +14,5 @@ require (
 	github.com/opentracing/opentracing-go v1.1.0
 	github.com/smartystreets/goconvey v1.7.2
 	go.uber.org/zap v1.19.0
+	google.golang.org/grpc v1.38.0
 )
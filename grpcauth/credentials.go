@@ -0,0 +1,202 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcauth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	midgardclient "go.aporeto.io/midgard-lib/client"
+	"go.uber.org/zap"
+)
+
+// A TokenManager issues and renews tokens.
+// It is implemented by tokenmanager.PeriodicTokenManager.
+type TokenManager interface {
+	Issue(ctx context.Context) (string, error)
+	Run(ctx context.Context, tokenCh chan string)
+}
+
+type credentialsOpts struct {
+	insecure bool
+}
+
+// A CredentialsOption is the type of various options
+// you can pass to NewTokenCredentials.
+type CredentialsOption func(*credentialsOpts)
+
+// OptCredentialsInsecure allows the credentials
+// to be sent over an insecure connection.
+func OptCredentialsInsecure() CredentialsOption {
+
+	return func(opts *credentialsOpts) {
+		opts.insecure = true
+	}
+}
+
+// TokenCredentials are credentials.PerRPCCredentials that send
+// the current token of a TokenManager in the authorization
+// metadata of each call.
+type TokenCredentials struct {
+	tokenManager TokenManager
+	opts         credentialsOpts
+
+	token     string
+	expiresAt time.Time
+	issuing   *issueCall
+	lock      sync.RWMutex
+}
+
+// An issueCall is an issuance of a token
+// shared by concurrent calls to Token.
+type issueCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// NewTokenCredentials returns new TokenCredentials using the given
+// TokenManager. The first token is issued on first use, and the
+// renewed tokens are used once Run is started.
+func NewTokenCredentials(tokenManager TokenManager, options ...CredentialsOption) *TokenCredentials {
+
+	if tokenManager == nil {
+		panic("tokenManager cannot be nil")
+	}
+
+	opts := credentialsOpts{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	return &TokenCredentials{
+		tokenManager: tokenManager,
+		opts:         opts,
+	}
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (c *TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+
+	token, err := c.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{authorizationKey: "Bearer " + token}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials.
+func (c *TokenCredentials) RequireTransportSecurity() bool {
+
+	return !c.opts.insecure
+}
+
+// Token returns the current token, issuing one if there is none
+// or if it expired. Concurrent calls share the same issuance.
+func (c *TokenCredentials) Token(ctx context.Context) (string, error) {
+
+	c.lock.RLock()
+	token, expiresAt := c.token, c.expiresAt
+	c.lock.RUnlock()
+
+	if isValid(token, expiresAt) {
+		return token, nil
+	}
+
+	c.lock.Lock()
+
+	if isValid(c.token, c.expiresAt) {
+		token = c.token
+		c.lock.Unlock()
+		return token, nil
+	}
+
+	// Only the first caller issues the token,
+	// the others wait for its result.
+	call := c.issuing
+	if call != nil {
+		c.lock.Unlock()
+		select {
+		case <-call.done:
+			return call.token, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	call = &issueCall{done: make(chan struct{})}
+	c.issuing = call
+	c.lock.Unlock()
+
+	call.token, call.err = c.tokenManager.Issue(ctx)
+
+	c.lock.Lock()
+	if call.err == nil {
+		c.setToken(call.token)
+	}
+	c.issuing = nil
+	c.lock.Unlock()
+
+	close(call.done)
+
+	return call.token, call.err
+}
+
+// Run runs the TokenManager and uses the renewed
+// tokens until the given context is done.
+// Without Run, Token issues a new token only
+// once the current one expired.
+func (c *TokenCredentials) Run(ctx context.Context) {
+
+	tokenCh := make(chan string)
+
+	go c.tokenManager.Run(ctx, tokenCh)
+
+	for {
+
+		select {
+
+		case token := <-tokenCh:
+
+			c.lock.Lock()
+			c.setToken(token)
+			c.lock.Unlock()
+
+			zap.L().Debug("gRPC credentials token renewed")
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// setToken sets the current token and its expiration time.
+// It must be called with the lock held.
+func (c *TokenCredentials) setToken(token string) {
+
+	c.token = token
+	c.expiresAt = time.Time{}
+
+	if claims, err := midgardclient.UnsecureTypedClaimsFromToken(token); err == nil {
+		c.expiresAt = claims.ExpiresAt()
+	}
+}
+
+// isValid returns true if the given token is set and
+// has not expired. Tokens that cannot be read and
+// tokens without expiration time never expire.
+func isValid(token string, expiresAt time.Time) bool {
+
+	return token != "" && (expiresAt.IsZero() || time.Now().Before(expiresAt))
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcauth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc/credentials"
+)
+
+type fakeTokenManager struct {
+	issued  int32
+	token   string
+	err     error
+	renewed string
+	release chan struct{}
+}
+
+func (m *fakeTokenManager) Issue(ctx context.Context) (string, error) {
+
+	atomic.AddInt32(&m.issued, 1)
+
+	if m.release != nil {
+		<-m.release
+	}
+
+	if m.err != nil {
+		return "", m.err
+	}
+
+	if m.token != "" {
+		return m.token, nil
+	}
+
+	return "token", nil
+}
+
+func (m *fakeTokenManager) Run(ctx context.Context, tokenCh chan string) {
+
+	select {
+	case tokenCh <- m.renewed:
+	case <-ctx.Done():
+	}
+}
+
+func TestTokenCredentials(t *testing.T) {
+
+	Convey("Given I create credentials without token manager", t, func() {
+		So(func() { NewTokenCredentials(nil) }, ShouldPanicWith, "tokenManager cannot be nil")
+	})
+
+	Convey("Given I have credentials", t, func() {
+
+		tm := &fakeTokenManager{renewed: "renewed"}
+
+		var c credentials.PerRPCCredentials = NewTokenCredentials(tm)
+
+		Convey("Then they should require transport security", func() {
+			So(c.RequireTransportSecurity(), ShouldBeTrue)
+		})
+
+		Convey("When I get the request metadata twice", func() {
+
+			md1, err1 := c.GetRequestMetadata(context.Background())
+			md2, err2 := c.GetRequestMetadata(context.Background())
+
+			Convey("Then the metadata should be correct", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(md1, ShouldResemble, map[string]string{"authorization": "Bearer token"})
+				So(md2, ShouldResemble, md1)
+			})
+
+			Convey("Then the token should have been issued once", func() {
+				So(atomic.LoadInt32(&tm.issued), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I run them", func() {
+
+			tc := c.(*TokenCredentials)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			go tc.Run(ctx)
+
+			var token string
+			for token != "renewed" {
+				select {
+				case <-ctx.Done():
+					panic("timeout exceeded")
+				case <-time.After(time.Millisecond):
+				}
+				token, _ = tc.Token(ctx)
+			}
+
+			Convey("Then the renewed token should be used", func() {
+				md, err := c.GetRequestMetadata(context.Background())
+				So(err, ShouldBeNil)
+				So(md["authorization"], ShouldEqual, "Bearer renewed")
+			})
+		})
+	})
+
+	Convey("Given I have credentials with a slow token manager", t, func() {
+
+		tm := &fakeTokenManager{release: make(chan struct{})}
+		c := NewTokenCredentials(tm)
+
+		Convey("When I get the token concurrently", func() {
+
+			var wg sync.WaitGroup
+			tokens := make([]string, 10)
+			for i := range tokens {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					tokens[i], _ = c.Token(context.Background())
+				}(i)
+			}
+
+			time.Sleep(50 * time.Millisecond)
+			close(tm.release)
+			wg.Wait()
+
+			Convey("Then the token should have been issued once", func() {
+				So(atomic.LoadInt32(&tm.issued), ShouldEqual, 1)
+				for _, token := range tokens {
+					So(token, ShouldEqual, "token")
+				}
+			})
+		})
+
+		Convey("When I get the token with a context that is canceled", func() {
+
+			go c.Token(context.Background()) // nolint: errcheck
+			time.Sleep(50 * time.Millisecond)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := c.Token(ctx)
+			close(tm.release)
+
+			Convey("Then err should be the context error", func() {
+				So(err, ShouldEqual, context.Canceled)
+			})
+		})
+	})
+
+	Convey("Given I have credentials with a token manager issuing expired tokens", t, func() {
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+		}).SignedString([]byte("secret"))
+		So(err, ShouldBeNil)
+
+		tm := &fakeTokenManager{token: token}
+		c := NewTokenCredentials(tm)
+
+		Convey("When I get the token twice", func() {
+
+			_, err1 := c.Token(context.Background())
+			_, err2 := c.Token(context.Background())
+
+			Convey("Then the token should have been issued twice", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(atomic.LoadInt32(&tm.issued), ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Given I have insecure credentials with a failing token manager", t, func() {
+
+		c := NewTokenCredentials(&fakeTokenManager{err: fmt.Errorf("boom")}, OptCredentialsInsecure())
+
+		Convey("Then they should not require transport security", func() {
+			So(c.RequireTransportSecurity(), ShouldBeFalse)
+		})
+
+		Convey("When I get the request metadata", func() {
+
+			_, err := c.GetRequestMetadata(context.Background())
+
+			Convey("Then err should not be nil", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "boom")
+			})
+		})
+	})
+}
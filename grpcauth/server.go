@@ -0,0 +1,146 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	midgardclient "go.aporeto.io/midgard-lib/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const authorizationKey = "authorization"
+
+// UnaryServerInterceptor returns a grpc.UnaryServerInterceptor that
+// authenticates the token sent in the authorization metadata of each call,
+// using the given Client, or the Verifier given with
+// midgardclient.OptMiddlewareVerifier.
+//
+// The token and its claims are stored in the context passed to the handler
+// and can be retrieved with midgardclient.TokenFromContext,
+// midgardclient.ClaimsFromContext and midgardclient.MidgardClaimsFromContext.
+//
+// Calls with a missing or invalid token are rejected with Unauthenticated.
+// Calls with a valid token that does not satisfy the VerifyOptions are
+// rejected with PermissionDenied. If midgard cannot be reached, they are
+// rejected with Unavailable.
+func UnaryServerInterceptor(client *midgardclient.Client, options ...midgardclient.MiddlewareOption) grpc.UnaryServerInterceptor {
+
+	authenticate := midgardclient.NewAuthenticatorFunc(client, options...)
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+		ctx, err := authenticateContext(ctx, authenticate)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a grpc.StreamServerInterceptor that
+// authenticates the token sent in the authorization metadata of each stream.
+// It behaves like UnaryServerInterceptor.
+func StreamServerInterceptor(client *midgardclient.Client, options ...midgardclient.MiddlewareOption) grpc.StreamServerInterceptor {
+
+	authenticate := midgardclient.NewAuthenticatorFunc(client, options...)
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+		ctx, err := authenticateContext(ss.Context(), authenticate)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authenticatedStream is a grpc.ServerStream
+// holding an authenticated context.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+
+	return s.ctx
+}
+
+// authenticateContext authenticates the token from the incoming
+// metadata of the given context and returns a context holding it.
+func authenticateContext(ctx context.Context, authenticate midgardclient.AuthenticatorFunc) (context.Context, error) {
+
+	token, err := extractToken(ctx)
+	if err != nil {
+		return nil, authError(http.StatusUnauthorized, err)
+	}
+
+	claims, midgardClaims, err := authenticate(ctx, token)
+	if err != nil {
+		return nil, authError(midgardclient.AuthErrorStatusCode(err), err)
+	}
+
+	return midgardclient.ContextWithAuth(ctx, token, claims, midgardClaims), nil
+}
+
+// extractToken extracts the bearer token from the
+// authorization metadata of the given context.
+func extractToken(ctx context.Context) (string, error) {
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(authorizationKey)
+	if len(values) == 0 {
+		return "", fmt.Errorf("missing authorization metadata: %w", midgardclient.ErrNoToken)
+	}
+
+	return midgardclient.ParseAuthorization(values[0])
+}
+
+// authError logs the given error and returns the status to reject a call
+// for the given HTTP status code. The status never contains the details of
+// the error, as they may contain internal details.
+func authError(code int, err error) error {
+
+	if code == http.StatusServiceUnavailable {
+		zap.L().Error("Unable to authenticate call", zap.Error(err))
+	} else {
+		zap.L().Debug("Authentication rejected", zap.Int("code", code), zap.Error(err))
+	}
+
+	return status.Error(statusCode(code), midgardclient.AuthErrorDescription(code))
+}
+
+// statusCode returns the gRPC code to use
+// to reject a call for the given HTTP status code.
+func statusCode(code int) codes.Code {
+
+	switch code {
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusRequestTimeout:
+		return codes.Canceled
+	default:
+		return codes.Unauthenticated
+	}
+}
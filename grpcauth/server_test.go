@@ -0,0 +1,200 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia"
+	midgardclient "go.aporeto.io/midgard-lib/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func makeMidgard() *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authn := gaia.NewAuthn()
+		_ = json.NewDecoder(r.Body).Decode(authn)
+		if authn.Token != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, `[{"code":401,"title":"Unauthorized","description":"nope","subject":"midgard"}]`)
+			return
+		}
+		fmt.Fprintln(w, `{"claims":{"sub":"john"}}`)
+	}))
+}
+
+func incomingContext(authorization string) context.Context {
+
+	if authorization == "" {
+		return context.Background()
+	}
+
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", authorization))
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context {
+
+	return s.ctx
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+
+	Convey("Given I have a unary interceptor using a midgard server", t, func() {
+
+		ts := makeMidgard()
+		defer ts.Close()
+
+		interceptor := UnaryServerInterceptor(midgardclient.NewClient(ts.URL))
+
+		var receivedCtx context.Context
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			receivedCtx = ctx
+			return "ok", nil
+		}
+
+		Convey("When I call it with a valid token", func() {
+
+			resp, err := interceptor(incomingContext("bearer good"), nil, &grpc.UnaryServerInfo{}, handler)
+
+			Convey("Then the handler should be called", func() {
+				So(err, ShouldBeNil)
+				So(resp, ShouldEqual, "ok")
+			})
+
+			Convey("Then the claims should be in the context", func() {
+				token, _ := midgardclient.TokenFromContext(receivedCtx)
+				claims, _ := midgardclient.ClaimsFromContext(receivedCtx)
+				So(token, ShouldEqual, "good")
+				So(claims, ShouldResemble, []string{"@auth:subject=john"})
+			})
+		})
+
+		Convey("When I call it with a valid token and extra whitespace", func() {
+
+			_, err := interceptor(incomingContext("  Bearer   good "), nil, &grpc.UnaryServerInfo{}, handler)
+
+			Convey("Then the token should be extracted", func() {
+				So(err, ShouldBeNil)
+				token, _ := midgardclient.TokenFromContext(receivedCtx)
+				So(token, ShouldEqual, "good")
+			})
+		})
+
+		Convey("When I call it with an invalid token", func() {
+
+			_, err := interceptor(incomingContext("Bearer bad"), nil, &grpc.UnaryServerInfo{}, handler)
+
+			Convey("Then err should be Unauthenticated", func() {
+				So(status.Code(err), ShouldEqual, codes.Unauthenticated)
+				So(receivedCtx, ShouldBeNil)
+			})
+		})
+
+		Convey("When I call it without metadata", func() {
+
+			_, err := interceptor(incomingContext(""), nil, &grpc.UnaryServerInfo{}, handler)
+
+			Convey("Then err should be Unauthenticated", func() {
+				So(status.Code(err), ShouldEqual, codes.Unauthenticated)
+				So(status.Convert(err).Message(), ShouldEqual, "The token is missing or invalid.")
+			})
+		})
+
+		Convey("When I call it with malformed metadata", func() {
+
+			_, err := interceptor(incomingContext("Basic good"), nil, &grpc.UnaryServerInfo{}, handler)
+
+			Convey("Then err should be Unauthenticated", func() {
+				So(status.Code(err), ShouldEqual, codes.Unauthenticated)
+				So(status.Convert(err).Message(), ShouldEqual, "The token is missing or invalid.")
+			})
+		})
+	})
+
+	Convey("Given I have a unary interceptor using a midgard server that is down", t, func() {
+
+		ts := makeMidgard()
+		url := ts.URL
+		ts.Close()
+
+		policy := midgardclient.DefaultRetryPolicy()
+		policy.MaxAttempts = 1
+
+		interceptor := UnaryServerInterceptor(midgardclient.NewClientWithRetryPolicy(url, nil, policy))
+
+		Convey("When I call it", func() {
+
+			_, err := interceptor(incomingContext("Bearer good"), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			})
+
+			Convey("Then err should be Unavailable", func() {
+				So(status.Code(err), ShouldEqual, codes.Unavailable)
+				So(status.Convert(err).Message(), ShouldNotContainSubstring, url)
+			})
+		})
+	})
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+
+	Convey("Given I have a stream interceptor using a midgard server", t, func() {
+
+		ts := makeMidgard()
+		defer ts.Close()
+
+		interceptor := StreamServerInterceptor(midgardclient.NewClient(ts.URL))
+
+		var receivedCtx context.Context
+		handler := func(srv interface{}, ss grpc.ServerStream) error {
+			receivedCtx = ss.Context()
+			return nil
+		}
+
+		Convey("When I call it with a valid token", func() {
+
+			err := interceptor(nil, &fakeServerStream{ctx: incomingContext("Bearer good")}, &grpc.StreamServerInfo{}, handler)
+
+			Convey("Then the stream context should hold the claims", func() {
+				So(err, ShouldBeNil)
+				claims, ok := midgardclient.ClaimsFromContext(receivedCtx)
+				So(ok, ShouldBeTrue)
+				So(claims, ShouldResemble, []string{"@auth:subject=john"})
+			})
+		})
+
+		Convey("When I call it with an invalid token", func() {
+
+			err := interceptor(nil, &fakeServerStream{ctx: incomingContext("Bearer bad")}, &grpc.StreamServerInfo{}, handler)
+
+			Convey("Then err should be Unauthenticated", func() {
+				So(status.Code(err), ShouldEqual, codes.Unauthenticated)
+				So(receivedCtx, ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,17 @@
+module go.aporeto.io/midgard-lib/oteltracer
+
+go 1.16
+
+require (
+	go.aporeto.io/gaia v1.94.1-0.20220608215959-187fca4731d5
+	go.aporeto.io/midgard-lib v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/smartystreets/goconvey v1.7.2
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+)
+
+replace go.aporeto.io/midgard-lib => ../
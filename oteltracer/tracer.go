@@ -0,0 +1,140 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oteltracer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	midgardclient "go.aporeto.io/midgard-lib/client"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "go.aporeto.io/midgard-lib"
+
+type tracerOpts struct {
+	tracerProvider trace.TracerProvider
+	propagator     propagation.TextMapPropagator
+}
+
+// An Option is the type of various options
+// you can pass to NewTracer.
+type Option func(*tracerOpts)
+
+// OptTracerProvider sets the TracerProvider used to create the spans.
+// By default, the global TracerProvider is used.
+func OptTracerProvider(tracerProvider trace.TracerProvider) Option {
+
+	return func(opts *tracerOpts) {
+		opts.tracerProvider = tracerProvider
+	}
+}
+
+// OptPropagator sets the propagator used to propagate the trace context
+// to midgard. By default, the W3C trace context headers are used.
+func OptPropagator(propagator propagation.TextMapPropagator) Option {
+
+	return func(opts *tracerOpts) {
+		opts.propagator = propagator
+	}
+}
+
+// NewTracer returns a midgardclient.Tracer emitting OpenTelemetry spans.
+// The tags set by the client, like the realm, the endpoint, the status
+// code and the retry attempt, are recorded as span attributes.
+func NewTracer(options ...Option) midgardclient.Tracer {
+
+	opts := tracerOpts{
+		tracerProvider: otel.GetTracerProvider(),
+		propagator:     propagation.TraceContext{},
+	}
+
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	return &tracer{
+		tracer:     opts.tracerProvider.Tracer(instrumentationName),
+		propagator: opts.propagator,
+	}
+}
+
+type tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (t *tracer) StartSpan(ctx context.Context, name string) (midgardclient.Span, context.Context) {
+
+	subctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+
+	return &span{span: s}, subctx
+}
+
+func (t *tracer) StartServerSpan(ctx context.Context, name string, header http.Header) (midgardclient.Span, context.Context) {
+
+	ctx = t.propagator.Extract(ctx, propagation.HeaderCarrier(header))
+	subctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+
+	return &span{span: s}, subctx
+}
+
+func (t *tracer) Inject(ctx context.Context, header http.Header) error {
+
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+
+	return nil
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s *span) SetTag(key string, value interface{}) {
+
+	s.span.SetAttributes(toAttribute(key, value))
+}
+
+func (s *span) SetError(err error) {
+
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *span) Finish() {
+
+	s.span.End()
+}
+
+// toAttribute converts the given tag to an attribute.
+func toAttribute(key string, value interface{}) attribute.KeyValue {
+
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
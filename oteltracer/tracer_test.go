@@ -0,0 +1,175 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oteltracer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/gaia"
+	midgardclient "go.aporeto.io/midgard-lib/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func attributes(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+
+	return attrs
+}
+
+func TestTracer_Client(t *testing.T) {
+
+	Convey("Given I have a client using an OpenTelemetry tracer", t, func() {
+
+		var traceparent string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceparent = r.Header.Get("Traceparent")
+			issue := gaia.NewIssue()
+			_ = json.NewDecoder(r.Body).Decode(issue)
+			issue.Token = "token"
+			_ = json.NewEncoder(w).Encode(issue)
+		}))
+		defer ts.Close()
+
+		recorder := tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+		cl := midgardclient.NewClient(ts.URL)
+		cl.Tracer = NewTracer(OptTracerProvider(provider))
+
+		Convey("When I issue a token", func() {
+
+			token, err := cl.IssueFromCertificate(context.Background(), time.Minute)
+
+			Convey("Then err should be nil", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "token")
+			})
+
+			spans := recorder.Ended()
+
+			Convey("Then the spans should have been recorded", func() {
+				So(len(spans), ShouldEqual, 2)
+				So(spans[0].Name(), ShouldEqual, "midgardlib.client.send")
+				So(spans[1].Name(), ShouldEqual, "midgardlib.client.issue.certificate")
+				So(spans[0].Parent().SpanID(), ShouldEqual, spans[1].SpanContext().SpanID())
+			})
+
+			Convey("Then the attributes should be set", func() {
+				So(attributes(spans[1])["realm"].AsString(), ShouldEqual, string(gaia.IssueRealmCertificate))
+				attrs := attributes(spans[0])
+				So(attrs["attempt"].AsInt64(), ShouldEqual, 1)
+				So(attrs["endpoint"].AsString(), ShouldEqual, ts.URL)
+				So(attrs["http.status_code"].AsInt64(), ShouldEqual, http.StatusOK)
+			})
+
+			Convey("Then the W3C trace context should have been propagated", func() {
+				So(traceparent, ShouldStartWith, "00-"+spans[0].SpanContext().TraceID().String()+"-"+spans[0].SpanContext().SpanID().String())
+			})
+		})
+	})
+
+	Convey("Given I have a client using an OpenTelemetry tracer and a midgard server that is down", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		url := ts.URL
+		ts.Close()
+
+		recorder := tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+		policy := midgardclient.DefaultRetryPolicy()
+		policy.MaxAttempts = 1
+
+		cl := midgardclient.NewClientWithRetryPolicy(url, nil, policy)
+		cl.Tracer = NewTracer(OptTracerProvider(provider))
+
+		Convey("When I issue a token", func() {
+
+			_, err := cl.IssueFromCertificate(context.Background(), time.Minute)
+
+			Convey("Then the error should be recorded", func() {
+				So(err, ShouldNotBeNil)
+				spans := recorder.Ended()
+				So(spans[0].Status().Code, ShouldEqual, codes.Error)
+				So(len(spans[0].Events()), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestTracer_Middleware(t *testing.T) {
+
+	Convey("Given I have a middleware using a client with an OpenTelemetry tracer", t, func() {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer ts.Close()
+
+		recorder := tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+		policy := midgardclient.DefaultRetryPolicy()
+		policy.MaxAttempts = 1
+
+		cl := midgardclient.NewClientWithRetryPolicy(ts.URL, nil, policy)
+		cl.Tracer = NewTracer(OptTracerProvider(provider))
+
+		handler := midgardclient.NewHTTPMiddleware(cl)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		Convey("When I send a request with a propagated trace context", func() {
+
+			traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+			spanID := "00f067aa0ba902b7"
+
+			req := httptest.NewRequest(http.MethodGet, "/path?token=secret", nil)
+			req.Header.Set("Authorization", "Bearer bad")
+			req.Header.Set("Traceparent", "00-"+traceID+"-"+spanID+"-01")
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			spans := recorder.Ended()
+
+			Convey("Then the server span should continue the propagated trace", func() {
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+				So(len(spans), ShouldEqual, 3)
+				s := spans[2]
+				So(s.Name(), ShouldEqual, "midgardlib.middleware.authenticate")
+				So(s.SpanKind(), ShouldEqual, trace.SpanKindServer)
+				So(s.SpanContext().TraceID().String(), ShouldEqual, traceID)
+				So(s.Parent().SpanID().String(), ShouldEqual, spanID)
+			})
+
+			Convey("Then the request should be traced without the query", func() {
+				attrs := attributes(spans[2])
+				So(attrs["http.url"].AsString(), ShouldEqual, "/path")
+				So(attrs["http.status_code"].AsInt64(), ShouldEqual, http.StatusUnauthorized)
+				So(spans[2].Status().Code, ShouldEqual, codes.Error)
+			})
+		})
+	})
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenmanager
+
+import (
+	"time"
+)
+
+// A MetricsRecorder records metrics about the tokens
+// issued and renewed by a PeriodicTokenManager.
+type MetricsRecorder interface {
+
+	// ObserveIssue is called when a token issuance completes.
+	ObserveIssue(duration time.Duration, err error)
+
+	// SetConsecutiveFailures is called with the number of
+	// consecutive failed issuances after each issuance.
+	SetConsecutiveFailures(failures int)
+
+	// SetSecondsUntilExpiry is called after each issuance and
+	// periodically by Run with the number of seconds until the
+	// current token expires.
+	SetSecondsUntilExpiry(seconds float64)
+}
+
+type noopMetricsRecorder struct{}
+
+func (noopMetricsRecorder) ObserveIssue(time.Duration, error) {}
+func (noopMetricsRecorder) SetConsecutiveFailures(int)        {}
+func (noopMetricsRecorder) SetSecondsUntilExpiry(float64)     {}
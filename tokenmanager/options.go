@@ -0,0 +1,46 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenmanager
+
+type tokenManagerOpts struct {
+	metrics   MetricsRecorder
+	reissueOn <-chan struct{}
+}
+
+// An Option is the type of various options
+// you can pass to the token managers.
+type Option func(*tokenManagerOpts)
+
+// OptMetricsRecorder sets the MetricsRecorder used
+// to record metrics about the issued tokens.
+// If recorder is nil, no metrics are recorded.
+func OptMetricsRecorder(recorder MetricsRecorder) Option {
+
+	return func(opts *tokenManagerOpts) {
+		if recorder == nil {
+			opts.metrics = noopMetricsRecorder{}
+			return
+		}
+		opts.metrics = recorder
+	}
+}
+
+// OptReissueOn makes Run issue a new token as soon as a value is
+// received on the given channel, like the one returned by
+// CredentialsWatcher.Subscribe, instead of waiting for the next
+// renewal.
+func OptReissueOn(events <-chan struct{}) Option {
+
+	return func(opts *tokenManagerOpts) {
+		opts.reissueOn = events
+	}
+}
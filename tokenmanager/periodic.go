@@ -13,8 +13,10 @@ package tokenmanager
 
 import (
 	"context"
+	"sync"
 	"time"
 
+	midgardclient "go.aporeto.io/midgard-lib/client"
 	"go.uber.org/zap"
 )
 
@@ -28,25 +30,64 @@ type TokenIssuerFunc func(context.Context, time.Duration) (string, error)
 type PeriodicTokenManager struct {
 	validity   time.Duration
 	issuerFunc TokenIssuerFunc
+	opts       tokenManagerOpts
+
+	// beforeReissue is called before issuing a
+	// token when a reissue event is received.
+	beforeReissue func()
+
+	failures  int
+	expiresAt time.Time
+	lock      sync.Mutex
 }
 
 // NewPeriodicTokenManager returns a new PeriodicTokenManager backed by midgard.
-func NewPeriodicTokenManager(validity time.Duration, issuerFunc TokenIssuerFunc) *PeriodicTokenManager {
+func NewPeriodicTokenManager(validity time.Duration, issuerFunc TokenIssuerFunc, options ...Option) *PeriodicTokenManager {
 
 	if issuerFunc == nil {
 		panic("issuerFunc cannot be nil")
 	}
 
+	opts := tokenManagerOpts{
+		metrics: noopMetricsRecorder{},
+	}
+
+	for _, opt := range options {
+		opt(&opts)
+	}
+
 	return &PeriodicTokenManager{
 		issuerFunc: issuerFunc,
 		validity:   validity,
+		opts:       opts,
 	}
 }
 
 // Issue issues a token.
 func (m *PeriodicTokenManager) Issue(ctx context.Context) (token string, err error) {
 
-	return m.issuerFunc(ctx, m.validity)
+	start := time.Now()
+
+	token, err = m.issuerFunc(ctx, m.validity)
+
+	m.opts.metrics.ObserveIssue(time.Since(start), err)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err != nil {
+		m.failures++
+		m.opts.metrics.SetConsecutiveFailures(m.failures)
+		return "", err
+	}
+
+	m.failures = 0
+	m.expiresAt = tokenExpiry(token, start.Add(m.validity))
+
+	m.opts.metrics.SetConsecutiveFailures(m.failures)
+	m.opts.metrics.SetSecondsUntilExpiry(time.Until(m.expiresAt).Seconds())
+
+	return token, nil
 }
 
 // Run runs the token renewal job.
@@ -60,27 +101,84 @@ func (m *PeriodicTokenManager) Run(ctx context.Context, tokenCh chan string) {
 
 		case <-time.After(tickDuration):
 
+			m.reportExpiry()
+
 			now := time.Now()
 			if now.Before(nextRefresh) {
 				break
 			}
 
-			subctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-			token, err := m.Issue(subctx)
-			cancel()
-
-			if err != nil {
-				zap.L().Error("Unable to renew token", zap.Error(err))
+			if !m.renew(ctx, tokenCh) {
 				break
 			}
 
-			tokenCh <- token
-
 			nextRefresh = now.Add(m.validity / 2)
 			zap.L().Info("Token renewed")
 
+		case <-m.opts.reissueOn:
+
+			if m.beforeReissue != nil {
+				m.beforeReissue()
+			}
+
+			now := time.Now()
+			if !m.renew(ctx, tokenCh) {
+				break
+			}
+
+			nextRefresh = now.Add(m.validity / 2)
+			zap.L().Info("Token reissued")
+
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+// renew issues a new token and sends it to the given channel.
+// It returns false if the token cannot be issued or sent
+// before the given context is done.
+func (m *PeriodicTokenManager) renew(ctx context.Context, tokenCh chan string) bool {
+
+	subctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	token, err := m.Issue(subctx)
+	cancel()
+
+	if err != nil {
+		zap.L().Error("Unable to renew token", zap.Error(err))
+		return false
+	}
+
+	select {
+	case tokenCh <- token:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// reportExpiry reports the number of seconds
+// until the current token expires, if any.
+func (m *PeriodicTokenManager) reportExpiry() {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.expiresAt.IsZero() {
+		return
+	}
+
+	m.opts.metrics.SetSecondsUntilExpiry(time.Until(m.expiresAt).Seconds())
+}
+
+// tokenExpiry returns the expiration time of the given
+// token, or the given default if it cannot be read.
+func tokenExpiry(token string, def time.Time) time.Time {
+
+	claims, err := midgardclient.UnsecureTypedClaimsFromToken(token)
+	if err != nil || claims.ExpiresAt().IsZero() {
+		return def
+	}
+
+	return claims.ExpiresAt()
+}
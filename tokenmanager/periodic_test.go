@@ -14,10 +14,12 @@ package tokenmanager
 import (
 	"context"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -138,3 +140,184 @@ func TestTokenManager_Run(t *testing.T) {
 		})
 	})
 }
+
+func TestTokenManager_Reissue(t *testing.T) {
+
+	Convey("Given I have a token manager that reissues on events", t, func() {
+
+		var called int32
+		tf := func(ctx context.Context, v time.Duration) (string, error) {
+			atomic.AddInt32(&called, 1)
+			return "token!", nil
+		}
+
+		events := make(chan struct{}, 1)
+		tm := NewPeriodicTokenManager(time.Hour, tf, OptReissueOn(events))
+
+		var before int32
+		tm.beforeReissue = func() { atomic.AddInt32(&before, 1) }
+
+		Convey("When I call Run and send an event", func() {
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			tokenCh := make(chan string)
+			go tm.Run(ctx, tokenCh)
+
+			events <- struct{}{}
+
+			var token string
+			select {
+			case token = <-tokenCh:
+			case <-ctx.Done():
+				panic("timeout exceeded")
+			}
+
+			Convey("Then a token should have been issued right away", func() {
+				So(token, ShouldEqual, "token!")
+				So(atomic.LoadInt32(&called), ShouldEqual, 1)
+				So(atomic.LoadInt32(&before), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I send an event and nobody receives the token", func() {
+
+			ctx, cancel := context.WithCancel(context.Background())
+
+			done := make(chan struct{})
+			go func() {
+				tm.Run(ctx, make(chan string))
+				close(done)
+			}()
+
+			events <- struct{}{}
+			for atomic.LoadInt32(&called) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+
+			Convey("Then Run should return", func() {
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					panic("timeout exceeded")
+				}
+			})
+		})
+	})
+}
+
+type fakeMetricsRecorder struct {
+	issues   int
+	failures []int
+	expiries []float64
+	lock     sync.Mutex
+}
+
+func (r *fakeMetricsRecorder) ObserveIssue(time.Duration, error) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.issues++
+}
+
+func (r *fakeMetricsRecorder) SetConsecutiveFailures(failures int) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.failures = append(r.failures, failures)
+}
+
+func (r *fakeMetricsRecorder) SetSecondsUntilExpiry(seconds float64) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.expiries = append(r.expiries, seconds)
+}
+
+func TestTokenManager_Metrics(t *testing.T) {
+
+	Convey("Given I have a token manager with a metrics recorder", t, func() {
+
+		var fail bool
+		tf := func(ctx context.Context, v time.Duration) (string, error) {
+			if fail {
+				return "", fmt.Errorf("bim")
+			}
+			return makeUnsignedToken(time.Now().Add(time.Hour)), nil
+		}
+
+		r := &fakeMetricsRecorder{}
+		tm := NewPeriodicTokenManager(10*time.Second, tf, OptMetricsRecorder(r))
+
+		Convey("When I issue tokens that fail twice then succeed", func() {
+
+			fail = true
+			_, _ = tm.Issue(context.Background())
+			_, _ = tm.Issue(context.Background())
+			fail = false
+			_, err := tm.Issue(context.Background())
+
+			Convey("Then the metrics should be correct", func() {
+				So(err, ShouldBeNil)
+				So(r.issues, ShouldEqual, 3)
+				So(r.failures, ShouldResemble, []int{1, 2, 0})
+				So(len(r.expiries), ShouldEqual, 1)
+				So(r.expiries[0], ShouldBeBetween, 3590, 3601)
+			})
+		})
+	})
+
+	Convey("Given I have a token manager with a nil metrics recorder", t, func() {
+
+		tf := func(ctx context.Context, v time.Duration) (string, error) {
+			return "token!", nil
+		}
+
+		tm := NewPeriodicTokenManager(10*time.Second, tf, OptMetricsRecorder(nil))
+
+		Convey("When I issue a token", func() {
+
+			token, err := tm.Issue(context.Background())
+
+			Convey("Then it should not panic", func() {
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "token!")
+			})
+		})
+	})
+
+	Convey("Given I have a token manager issuing tokens that cannot be parsed", t, func() {
+
+		tf := func(ctx context.Context, v time.Duration) (string, error) {
+			return "token!", nil
+		}
+
+		r := &fakeMetricsRecorder{}
+		tm := NewPeriodicTokenManager(10*time.Second, tf, OptMetricsRecorder(r))
+
+		Convey("When I issue a token", func() {
+
+			_, _ = tm.Issue(context.Background())
+
+			Convey("Then the expiry should be derived from the validity", func() {
+				So(len(r.expiries), ShouldEqual, 1)
+				So(r.expiries[0], ShouldBeBetween, 9, 10.1)
+			})
+		})
+	})
+}
+
+func makeUnsignedToken(expiresAt time.Time) string {
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, &jwt.StandardClaims{ExpiresAt: expiresAt.Unix()}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		panic(err)
+	}
+
+	return token
+}
@@ -14,20 +14,53 @@ package tokenmanager
 import (
 	"context"
 	"crypto/tls"
+	"net/url"
 	"time"
 
 	midgardclient "go.aporeto.io/midgard-lib/client"
 )
 
 // NewX509TokenManager returns a new X509TokenManager.
-func NewX509TokenManager(url string, validity time.Duration, tlsConfig *tls.Config) *PeriodicTokenManager {
+//
+// To use rotated certificates, use NewX509TokenManagerFromWatcher.
+func NewX509TokenManager(url string, validity time.Duration, tlsConfig *tls.Config, options ...Option) *PeriodicTokenManager {
 
 	cl := midgardclient.NewClientWithTLS(url, tlsConfig)
 
-	return &PeriodicTokenManager{
-		validity: validity,
-		issuerFunc: func(ctx context.Context, v time.Duration) (string, error) {
+	m := NewPeriodicTokenManager(
+		validity,
+		func(ctx context.Context, v time.Duration) (string, error) {
 			return cl.IssueFromCertificate(ctx, v)
 		},
+		options...,
+	)
+
+	// Make sure the new token is issued using the
+	// current certificate and not an idle connection.
+	m.beforeReissue = cl.CloseIdleConnections
+
+	return m
+}
+
+// NewX509TokenManagerFromWatcher returns a new X509TokenManager using
+// the credentials of the given CredentialsWatcher. A new token is issued
+// with the new certificate as soon as the credentials are reloaded, and
+// the reloaded ca is trusted to verify the certificate of midgard.
+func NewX509TokenManagerFromWatcher(midgardURL string, validity time.Duration, watcher *midgardclient.CredentialsWatcher, options ...Option) *PeriodicTokenManager {
+
+	if watcher == nil {
+		panic("watcher cannot be nil")
 	}
+
+	u, err := url.Parse(midgardURL)
+	if err != nil || u.Hostname() == "" {
+		panic("midgardURL must be a valid url")
+	}
+
+	options = append(
+		[]Option{OptReissueOn(watcher.Subscribe())},
+		options...,
+	)
+
+	return NewX509TokenManager(midgardURL, validity, watcher.ClientTLSConfig(u.Hostname()), options...)
 }
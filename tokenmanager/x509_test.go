@@ -13,13 +13,24 @@ package tokenmanager
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	midgardclient "go.aporeto.io/midgard-lib/client"
 )
 
 func TestTOkenManager_NewX509TokenManager(t *testing.T) {
@@ -52,3 +63,70 @@ func TestTOkenManager_NewX509TokenManager(t *testing.T) {
 		})
 	})
 }
+
+func TestTokenManager_NewX509TokenManagerFromWatcher(t *testing.T) {
+
+	Convey("Given I have a credentials watcher", t, func() {
+
+		dir, err := ioutil.TempDir("", "credentials")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint: errcheck
+
+		certPEM, keyPEM := makeTestCertificate()
+		certPath := filepath.Join(dir, "cert.pem")
+		keyPath := filepath.Join(dir, "key.pem")
+		So(ioutil.WriteFile(certPath, certPEM, 0600), ShouldBeNil)
+		So(ioutil.WriteFile(keyPath, keyPEM, 0600), ShouldBeNil)
+
+		w, err := midgardclient.NewPEMCredentialsWatcher(certPath, keyPath, "")
+		So(err, ShouldBeNil)
+
+		Convey("When I create a token manager from it", func() {
+
+			tm := NewX509TokenManagerFromWatcher("https://midgard:4443", 10*time.Second, w)
+
+			Convey("Then it should reissue tokens on reload", func() {
+				So(tm.opts.reissueOn, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I create a token manager from it with an invalid url", func() {
+
+			Convey("Then it should panic", func() {
+				So(func() { NewX509TokenManagerFromWatcher("midgard", 10*time.Second, w) }, ShouldPanicWith, "midgardURL must be a valid url")
+			})
+		})
+	})
+
+	Convey("Given I create a token manager without watcher", t, func() {
+		So(func() { NewX509TokenManagerFromWatcher("https://midgard", 10*time.Second, nil) }, ShouldPanicWith, "watcher cannot be nil")
+	})
+}
+
+func makeTestCertificate() (certPEM []byte, keyPEM []byte) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}